@@ -25,20 +25,33 @@
 package Annotate
 
 import (
+	"bytes"
 	"code.google.com/p/freetype-go/freetype"
 	"code.google.com/p/freetype-go/freetype/raster"
 	"code.google.com/p/freetype-go/freetype/truetype"
-	"image"
-	//"image/color"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	xdraw "golang.org/x/image/draw"
+	"image"
+	"image/color"
 	"image/draw"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // UnsupportedError type returned for unsupported image types
@@ -48,7 +61,48 @@ func (f UnsupportedError) Error() string {
 	return "Image format not supported: " + string(f)
 }
 
-// Rectangle is used for specifying text bounding box
+var (
+	// ErrNoFont is returned when text is measured or drawn before a font has been set
+	ErrNoFont = errors.New("Font not set")
+	// ErrNoSource is returned when text is drawn before a source image has been set
+	ErrNoSource = errors.New("Source image not set")
+	// ErrTextOverflow is returned when text does not fit inside of the bounding box even at the smallest font size,
+	// by WriteText and every other method that picks the font size to fit the box
+	ErrTextOverflow = errors.New("Text does not fit inside of the bounding box")
+	// ErrInvalidBox is returned when the bounding box can't hold any text
+	ErrInvalidBox = errors.New("Invalid bounding box")
+	// ErrVariableFontUnsupported is returned by SetFontVariation, since freetype-go can only render the
+	// default instance of a variable font
+	ErrVariableFontUnsupported = errors.New("Variable fonts not supported")
+	// ErrTooManyPixels is returned when the source image has more pixels than allowed by SetMaxPixels
+	ErrTooManyPixels = errors.New("Source image has too many pixels")
+	// ErrInvalidDPI is returned when the DPI is zero or negative, which would make text invisible
+	ErrInvalidDPI = errors.New("DPI must be greater than 0")
+)
+
+// BatchError is returned by AnnotateBatch when some of the images could not be annotated.
+// It maps the path of each failed image to the error for it
+type BatchError map[string]error
+
+func (b BatchError) Error() string {
+	paths := make([]string, 0, len(b))
+	for path := range b {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	messages := make([]string, len(paths))
+	for i, path := range paths {
+		messages[i] = path + ": " + b[path].Error()
+	}
+	return fmt.Sprintf("%d images failed: %s", len(b), strings.Join(messages, "; "))
+}
+
+// Rectangle is used for specifying text bounding box.
+//
+// X and Y may be negative, or the box may otherwise extend past the edges of the source image, to bleed text off
+// of the image. Only the part of the text that lands on the image is drawn. The box has to overlap the image
+// somewhere though, otherwise ErrInvalidBox is returned since none of the text could be seen
 type Rectangle struct {
 	X      int32
 	Y      int32
@@ -56,6 +110,67 @@ type Rectangle struct {
 	Height int32
 }
 
+// RectangleOf returns the Rectangle covering r
+func RectangleOf(r image.Rectangle) Rectangle {
+	return Rectangle{X: int32(r.Min.X), Y: int32(r.Min.Y), Width: int32(r.Dx()), Height: int32(r.Dy())}
+}
+
+// Rect returns the image.Rectangle covering r
+func (r Rectangle) Rect() image.Rectangle {
+	return image.Rect(int(r.X), int(r.Y), int(r.X+r.Width), int(r.Y+r.Height))
+}
+
+// Center returns the point in the middle of r, rounded toward the top-left
+func (r Rectangle) Center() image.Point {
+	return image.Pt(int(r.X+r.Width/2), int(r.Y+r.Height/2))
+}
+
+// Inset returns r shrunk by dx on the left and right and by dy on the top and bottom, e.g. to add padding
+// inside of a box. Negative values grow r instead. If r is too narrow or too short to shrink that far, the
+// result is empty in that direction, at r's center
+func (r Rectangle) Inset(dx, dy int32) Rectangle {
+	if r.Width < 2*dx {
+		r.X += r.Width / 2
+		r.Width = 0
+	} else {
+		r.X += dx
+		r.Width -= 2 * dx
+	}
+	if r.Height < 2*dy {
+		r.Y += r.Height / 2
+		r.Height = 0
+	} else {
+		r.Y += dy
+		r.Height -= 2 * dy
+	}
+	return r
+}
+
+// Intersect returns the largest Rectangle contained by both r and other. If they don't overlap the zero
+// Rectangle is returned
+func (r Rectangle) Intersect(other Rectangle) Rectangle {
+	return RectangleOf(r.Rect().Intersect(other.Rect()))
+}
+
+// RectangleRel is a bounding box given in fractions of the source image's width and height, e.g. Width 0.5 for
+// half as wide as the source, so the same box works for the source at any size
+type RectangleRel struct {
+	X      float64
+	Y      float64
+	Width  float64
+	Height float64
+}
+
+// Abs returns the bounding box for a source image with the given bounds
+func (r RectangleRel) Abs(bounds image.Rectangle) Rectangle {
+	return Rectangle{
+		X:      int32(bounds.Min.X) + int32(r.X*float64(bounds.Dx())+0.5),
+		Y:      int32(bounds.Min.Y) + int32(r.Y*float64(bounds.Dy())+0.5),
+		Width:  int32(r.Width*float64(bounds.Dx()) + 0.5),
+		Height: int32(r.Height*float64(bounds.Dy()) + 0.5),
+	}
+}
+
 // Color holds RGBA data. Implements image/color's color.Color interface
 type Color struct {
 	R, G, B, A uint32
@@ -65,45 +180,558 @@ func (c Color) RGBA() (uint32, uint32, uint32, uint32) {
 	return c.R, c.G, c.B, c.A
 }
 
+// Line is a single line of laid out text
 type Line struct {
-	Words     []string
-	XPos      int32
-	YPos      int32
+	Words []string
+	// XPos is where the pen starts for the first word and YPos is the baseline, in source image pixels
+	XPos int32
+	YPos int32
+	// the words joined by spaces, cached by createTextLines so the join isn't repeated when drawing
+	text string
+	// width used when wrapping and aligning, which includes some padding around each word
 	currWidth int32
-	//distance from the base of this line to the base of the line above it.
-	// height of line + line-spacing.
-	//for the first line it is just the line height
+	// width of the glyphs as they are drawn
+	width int32
+	// fractional pixel offset of XPos, only set when sub-pixel positioning is enabled
+	xFrac float64
+	// fractional pixel offset of YPos, only set when baselines aren't snapped to whole pixels
+	yFrac float64
+	// whether each word gets a highlight drawn behind it, nil for no highlights
+	highlighted []bool
+	// extra space added between each word when the line is justified
+	extraSpace int32
+	// where the pen ended up after drawing the line, set by drawLines
+	end image.Point
+	// ParagraphEnd is true for the last line of a paragraph, i.e. the line before a hard newline or
+	// the end of the text
+	ParagraphEnd bool
+	// BaseToBaseHeight is the vertical space this line adds to the layout. For every line but the first it is
+	// the distance from the baseline of the line above to this line's baseline, i.e. the line height plus the
+	// line spacing. For the first line it is the distance from the top of the bounding box to its baseline
 	BaseToBaseHeight int32
 }
 
+// Width returns the width of the line's glyphs as they are drawn, from XPos to the end of the last word, not
+// counting the extra space between the words of a justified line. It is measured at the DPI the line is drawn
+// at, so the line's entry in Result.LineEnds is XPos plus Width. It is only known for lines laid out by
+// Annotate, e.g. by Layout, and is 0 otherwise
+func (l *Line) Width() int32 {
+	return l.width
+}
+
+// Blank reports whether the line has no words, like the empty line in "a\n\nb". Blank lines take up a full
+// line of vertical space but nothing is drawn for them
+func (l *Line) Blank() bool {
+	return len(l.Words) == 0
+}
+
+// joined returns the words of the line joined by spaces, as they are drawn
+func (l *Line) joined() string {
+	if l.text != "" || len(l.Words) == 0 {
+		return l.text
+	}
+	return strings.Join(l.Words, " ")
+}
+
+// origin returns the starting pen position of the line in 24.8 fixed point, multiplied by scale
+func (l *Line) origin(scale int) raster.Point {
+	return raster.Point{
+		X: raster.Fix32(scale) * (raster.Fix32(l.XPos<<8) + raster.Fix32(l.xFrac*256)),
+		Y: raster.Fix32(scale) * (raster.Fix32(l.YPos<<8) + raster.Fix32(l.yFrac*256)),
+	}
+}
+
+// GlyphBox describes where a single rune of text is placed by the layout
+type GlyphBox struct {
+	Rune rune
+	// Line is the index of the wrapped line the rune is on
+	Line int
+	// Rect spans from the rune's pen position to the next rune's, and from the font's ascent to its descent
+	Rect image.Rectangle
+}
+
+// Span marks a range of the text passed to WriteTextWithSpans, such as a link
+type Span struct {
+	// Start and End are offsets into the text in runes, End is exclusive
+	Start, End int
+	// Data is passed through to the ResolvedSpan untouched, e.g. the URL of a link
+	Data interface{}
+}
+
+// ResolvedSpan is a Span along with where its text was drawn
+type ResolvedSpan struct {
+	Span
+	// Rects holds a rectangle for each line the span's text is drawn on, from top to bottom, in source image
+	// pixel coordinates. It is empty when none of the span's text was drawn
+	Rects []image.Rectangle
+}
+
+// Result holds the annotated image along with information about how the text was laid out
+type Result struct {
+	Image image.Image
+	// FontSize is the font size that was chosen to fit the text inside of the bounding box
+	FontSize int32
+	// FitAtMax is true when the text fit at the maximum font size, false when it had to be shrunk
+	FitAtMax bool
+	// Iterations is the number of font sizes that were tried before settling on FontSize
+	Iterations int32
+	// LineEnds holds, for each drawn line, where the pen ended up after the last word: X is just past the
+	// last glyph's advance and Y is the line's baseline, in source image pixels. It's the place to draw
+	// anything that should follow the text inline, like an icon
+	LineEnds []image.Point
+}
+
 const (
 	LEFT_ALIGNED = iota
 	CENTERED
+	// JUSTIFIED stretches the space between words so lines fill the width of the bounding box.
+	// The last line of each paragraph is left aligned
+	JUSTIFIED
+)
+
+// FillMode specifies how the image passed to SetFontImage covers the source image
+type FillMode int
+
+const (
+	// Unscaled draws the font image once at the top-left of the source, at its original size
+	Unscaled FillMode = iota
+	// Tile repeats the font image across the whole source
+	Tile
+	// Stretch scales the font image to the size of the source
+	Stretch
+)
+
+// GradientDirection specifies which way a gradient runs
+type GradientDirection int
+
+const (
+	// GradientVertical runs from the top edge to the bottom edge
+	GradientVertical GradientDirection = iota
+	// GradientHorizontal runs from the left edge to the right edge
+	GradientHorizontal
+)
+
+// TopAlign specifies what is lined up with the top of the bounding box
+type TopAlign int
+
+const (
+	// EmTop places the first baseline one em, the font size, below the top of the bounding box
+	EmTop TopAlign = iota
+	// AscentTop places the font's ascent line at the top of the bounding box
+	AscentTop
+	// CapHeightTop places the top of capital letters at the top of the bounding box, which is tighter than
+	// AscentTop. The cap height is measured from the font's "H" glyph, falling back to the ascent
+	CapHeightTop
+)
+
+// CaptionPosition specifies which edge of the image WriteCaption places its bar at
+type CaptionPosition int
+
+const (
+	CaptionTop CaptionPosition = iota
+	CaptionBottom
 )
 
+// FitStrategy specifies what has to fit inside of the bounding box when choosing a font size
+type FitStrategy int
+
+const (
+	// FitHeight shrinks the text until all of its lines fit within the height of the bounding box
+	FitHeight FitStrategy = iota
+	// FitWidth shrinks the text until its widest line fits within the width of the bounding box, which matters
+	// for long words that can't be wrapped. The height of the text is not considered
+	FitWidth
+	// FitWidthAndHeight shrinks the text until both its height and its widest line fit
+	FitWidthAndHeight
+)
+
+// KerningMode specifies how the spacing between pairs of glyphs is adjusted
+type KerningMode int
+
+const (
+	// KernNative uses all of the kerning data in the font that freetype-go can read
+	KernNative KerningMode = iota
+	// KernOff ignores the font's kerning data, so glyphs are spaced by their advances alone
+	KernOff
+	// KernMetricsOnly uses only the pair kerning of the font's kern table and ignores GPOS positioning. Since
+	// freetype-go only reads the kern table, this is currently the same as KernNative
+	KernMetricsOnly
+)
+
+// LineBreakAlgorithm specifies how wrapped text is broken into lines
+type LineBreakAlgorithm int
+
+const (
+	// Greedy fills each line with as many words as fit before starting the next one
+	Greedy LineBreakAlgorithm = iota
+	// Balanced uses as many lines as Greedy but moves words between them so the lines are as close to the same
+	// width as possible, which looks better for short titles that wrap over a few lines. It takes more time
+	// than Greedy for long paragraphs
+	Balanced
+)
+
+// OriginMode specifies which point of the text the position passed to WriteLine refers to
+type OriginMode int
+
+const (
+	// OriginBaseline places the start of the text's baseline at the position
+	OriginBaseline OriginMode = iota
+	// OriginTopLeft places the top-left corner of the text, at the font's ascent, at the position
+	OriginTopLeft
+)
+
+// TextRun is a piece of text for WriteRichText, drawn with its own font, color and size
+type TextRun struct {
+	Text string
+	// Font is the font of the run, nil for the Context's font
+	Font *truetype.Font
+	// Color is the color of the run, nil for the color set with SetFontColor
+	Color *Color
+	// Scale multiplies the font size chosen for the text, e.g. 1.5 for a run half again as big as the rest.
+	// 0 is the same as 1
+	Scale float64
+}
+
+// ListMarker specifies what WriteList draws in front of each item
+type ListMarker struct {
+	text     string
+	numbered bool
+}
+
+var (
+	// DiscMarker puts a bullet in front of each item
+	DiscMarker = ListMarker{text: "•"}
+	// DecimalMarker numbers the items starting from 1, like "1."
+	DecimalMarker = ListMarker{text: ".", numbered: true}
+)
+
+// CustomMarker puts s in front of each item
+func CustomMarker(s string) ListMarker {
+	return ListMarker{text: s}
+}
+
+// forItem returns the marker text for the item at index i
+func (m ListMarker) forItem(i int) string {
+	if m.numbered {
+		return fmt.Sprintf("%d%s", i+1, m.text)
+	}
+	return m.text
+}
+
+// DefaultDPI is the screen resolution used when SetDPI has not been called
+const DefaultDPI = 81.58
+
+// DefaultHighlightColor is the color used for highlighted words when SetWordHighlight has not been called
+var DefaultHighlightColor = Color{0xffff, 0xffff, 0, 0xffff}
+
+// DefaultFontColor is the color used for text when neither SetFontColor nor SetFontImage has been called
+var DefaultFontColor = Color{0, 0, 0, 0xffff}
+
 type Context struct {
 	src            image.Image
 	fontBackground draw.Image // font background
 	font           *truetype.Font
 	maxFontSize    int32
+	maxFontSizeRel float64 // max font size as a fraction of the source height, 0 when not set
 	dpi            float64
 	lineHeight     float64
 	fontColor      image.Image
+	fontImage      image.Image
+	fontImageMode  FillMode
+	fontImageShift image.Point
+	fontImageScale xdraw.Interpolator
+	textBackground image.Image // panel drawn behind the text, nil for none
+	textBgRadius   int32
 	fontSize       int32 //Font size calculated to fit inside of hte bounding box
 	debugEnabled   bool
 	alignment      int
+	subPixel       bool
+	antialias      bool
+	bottomPadding  int32
+	wordHighlight  image.Image
+	supersample    int
+	inPlace        bool
+	fitStrategy    FitStrategy
+	paragraphSpace float64
+	trimTrailing   bool
+	clampBox       bool
+	breakFunc      func(prev, next string) bool
+	backdropBlur   int
+	topAlign       TopAlign
+	gamma          float64
+	letterSpacing  int32
+	clipRect       image.Rectangle // empty for no clipping beyond the source bounds
+	glyphByGlyph   bool
+	opacity        float64
+	originMode     OriginMode
+	tolerance      int32 // how close to the largest fitting font size the search has to get
+	flipH          bool
+	flipV          bool
+	contrastColors []Color // light and dark text colors to choose between, nil when not set
+	lineWidthFunc  func(lineIndex int) int32
+	cjkBreaking    bool
+	leading        int32 // space between lines in pixels, used instead of lineHeight when useLeading is set
+	useLeading     bool
+	deterministic  bool
+	smartTypo      bool
+	maxPixels      int
+	sampleFilter   xdraw.Interpolator
+	minFontSize    int32
+	fontShaper     *Shaper // measures the font, see shaper
+	autoExpand     bool
+	expandColor    Color
+	kerning        KerningMode
+	runeMap        map[rune]rune // runes to draw in place of others, nil for none
+	noWrap         bool
+	lineBreaking   LineBreakAlgorithm
+	aspectLock     bool
+	lineCallback   func(lineIndex int, img image.Image)
+	baselineSnap   bool
+	reserved       Rectangle // area text keeps clear of, empty for none
+	bgColor        *Color    // color under transparent source pixels, nil for none
 }
 
 // NewContext returns a pointer to a new instance of Context
 func NewContext() *Context {
-	return &Context{}
+	return &Context{
+		fontColor:    image.NewUniform(DefaultFontColor),
+		dpi:          DefaultDPI,
+		antialias:    true,
+		gamma:        1,
+		opacity:      1,
+		tolerance:    1,
+		sampleFilter: xdraw.CatmullRom,
+		baselineSnap: true,
+	}
+}
+
+// imageFormat is an image format Annotate can both read and write
+type imageFormat struct {
+	name       string
+	extensions []string
+	encode     func(w io.Writer, img image.Image) error
+}
+
+var imageFormats = []imageFormat{
+	{"jpeg", []string{".jpg", ".jpeg"}, func(w io.Writer, img image.Image) error { return jpeg.Encode(w, img, nil) }},
+	{"png", []string{".png"}, png.Encode},
+}
+
+// SupportedFormats returns the names of the image formats Annotate can read sources from and write
+// annotated images to, e.g. "png"
+func SupportedFormats() []string {
+	names := make([]string, len(imageFormats))
+	for i, format := range imageFormats {
+		names[i] = format.name
+	}
+	return names
+}
+
+// formatForPath returns the image format matching the extension of path
+func formatForPath(path string) (imageFormat, bool) {
+	extension := strings.ToLower(filepath.Ext(path))
+	for _, format := range imageFormats {
+		for _, formatExtension := range format.extensions {
+			if extension == formatExtension {
+				return format, true
+			}
+		}
+	}
+	return imageFormat{}, false
+}
+
+// Option configures a Context created by one of the package level helpers such as AnnotateFile
+type Option func(c *Context)
+
+// WithMaxFontSize returns an Option that calls SetMaxFontSize
+func WithMaxFontSize(size int) Option {
+	return func(c *Context) { c.SetMaxFontSize(size) }
+}
+
+// WithDPI returns an Option that calls SetDPI
+func WithDPI(dpi float64) Option {
+	return func(c *Context) { c.SetDPI(dpi) }
+}
+
+// WithLineHeight returns an Option that calls SetLineHeight
+func WithLineHeight(height float64) Option {
+	return func(c *Context) { c.SetLineHeight(height) }
+}
+
+// WithFontColor returns an Option that calls SetFontColor
+func WithFontColor(rgbaColor Color) Option {
+	return func(c *Context) { c.SetFontColor(rgbaColor) }
+}
+
+// WithAlignment returns an Option that calls SetAlignment
+func WithAlignment(alignment int) Option {
+	return func(c *Context) { c.SetAlignment(alignment) }
+}
+
+// AnnotateFile draws text inside of boundingBox on the image at srcPath using the font at fontPath, and saves
+// the result to outPath. The output format is chosen from the extension of outPath.
+// The maximum font size defaults to the height of the bounding box, use opts to change it and other settings
+func AnnotateFile(srcPath, fontPath, text string, boundingBox Rectangle, outPath string, opts ...Option) error {
+	c := NewContext()
+	c.SetMaxFontSize(int(boundingBox.Height))
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if err := c.SetSrcPath(srcPath); err != nil {
+		return err
+	}
+	if err := c.SetFontPath(fontPath); err != nil {
+		return err
+	}
+	result, err := c.Render(text, boundingBox)
+	if err != nil {
+		return err
+	}
+	return saveImage(result.Image, outPath)
+}
+
+// AnnotateBatch draws text inside of boundingBox on every PNG and JPEG image in srcDir using the Context's
+// settings, and saves each result to outDir with the same file name. Images are annotated concurrently, one
+// per CPU. Failures don't stop the other images from being annotated; they are returned together as a BatchError
+func (c *Context) AnnotateBatch(srcDir, outDir, text string, boundingBox Rectangle) error {
+	files, err := ioutil.ReadDir(srcDir)
+	if err != nil {
+		return err
+	}
+
+	paths := make(chan string)
+	failures := BatchError{}
+	var failuresLock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				if err := c.annotateFile(path, outDir, text, boundingBox); err != nil {
+					failuresLock.Lock()
+					failures[path] = err
+					failuresLock.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, file := range files {
+		if _, ok := formatForPath(file.Name()); file.IsDir() || !ok {
+			continue
+		}
+		paths <- filepath.Join(srcDir, file.Name())
+	}
+	close(paths)
+	wg.Wait()
+
+	if len(failures) > 0 {
+		return failures
+	}
+	return nil
+}
+
+// annotateFile annotates the image at path with a clone of c and saves it to outDir
+func (c *Context) annotateFile(path, outDir, text string, boundingBox Rectangle) error {
+	clone := c.Clone()
+	if err := clone.SetSrcPath(path); err != nil {
+		return err
+	}
+	result, err := clone.Render(text, boundingBox)
+	if err != nil {
+		return err
+	}
+	return saveImage(result.Image, filepath.Join(outDir, filepath.Base(path)))
+}
+
+// formatForName returns the image format with the given name, as listed by SupportedFormats
+func formatForName(name string) (imageFormat, bool) {
+	for _, format := range imageFormats {
+		if strings.EqualFold(name, format.name) {
+			return format, true
+		}
+	}
+	return imageFormat{}, false
+}
+
+// Encoder encodes an image straight into whatever it is written to, without holding the encoded image in memory
+type Encoder struct {
+	img    image.Image
+	format imageFormat
+}
+
+// NewEncoder returns an Encoder that encodes img in format, one of SupportedFormats
+func NewEncoder(img image.Image, format string) (*Encoder, error) {
+	imgFormat, ok := formatForName(format)
+	if !ok {
+		return nil, UnsupportedError(format)
+	}
+	return &Encoder{img: img, format: imgFormat}, nil
+}
+
+// WriteTo encodes the image into w and returns the number of bytes written. It implements io.WriterTo
+func (e *Encoder) WriteTo(w io.Writer) (int64, error) {
+	counter := &countingWriter{w: w}
+	err := e.format.encode(counter, e.img)
+	return counter.n, err
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// saveImage encodes img to path in the format matching the extension of path
+func saveImage(img image.Image, path string) error {
+	format, ok := formatForPath(path)
+	if !ok {
+		return UnsupportedError(strings.ToLower(filepath.Ext(path)))
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err = format.encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Clone returns a copy of the Context that can be configured independently of the original.
+// The parsed font and the source image are shared with the original, but the font background buffer is copied
+func (c *Context) Clone() *Context {
+	clone := *c
+	if c.fontBackground != nil {
+		fontBackground := image.NewRGBA(c.fontBackground.Bounds())
+		draw.Draw(fontBackground, fontBackground.Bounds(), c.fontBackground, fontBackground.Bounds().Min, draw.Src)
+		clone.fontBackground = fontBackground
+		if c.fontImage != nil {
+			clone.fontColor = fontBackground
+		}
+	}
+	return &clone
 }
 
 // SetSrc sets the srouce image. This is the image on which the annotation is to be drawn
-// As of right now, Annotate only supports JPEG and PNG formats
+// As of right now, Annotate only supports JPEG and PNG formats.
+// The alpha channel of the source is kept, unless SetBackgroundColor is used, so transparent pixels that nothing
+// is drawn over stay transparent and text is composited over them, e.g. when annotating a PNG with a transparent
+// background
 func (c *Context) SetSrc(src image.Image) {
 	c.src = src
-	c.fontBackground = image.NewRGBA(src.Bounds())
+	c.fillFontBackground()
 }
 
 func (c *Context) EnableDebugging(enable bool) {
@@ -111,33 +739,42 @@ func (c *Context) EnableDebugging(enable bool) {
 }
 
 // SetSrcPath does same thing as SetSrc, except it will fetch the image, given the path to it.
+// The format is detected from the contents of the file rather than its extension.
 // As of right now, Annotate only supports JPEG and PNG formats
 func (c *Context) SetSrcPath(path string) error {
 	imageRaw, err := os.Open(path)
 	if err != nil {
 		return err
 	}
+	defer imageRaw.Close()
 
-	var imageDecoded image.Image
-
-	extension := strings.ToLower(filepath.Ext(path))
-	switch extension {
-	case ".png":
-		imageDecoded, err = png.Decode(imageRaw)
-		break
-	case ".jpg", ".jpeg":
-		imageDecoded, err = jpeg.Decode(imageRaw)
-		break
-	default:
-		return UnsupportedError(extension)
+	// check the size from the header before decoding allocates the whole image
+	if c.maxPixels > 0 {
+		config, _, err := image.DecodeConfig(imageRaw)
+		if err == image.ErrFormat {
+			return UnsupportedError(strings.ToLower(filepath.Ext(path)))
+		}
+		if err != nil {
+			return err
+		}
+		if err = c.checkPixels(image.Rect(0, 0, config.Width, config.Height)); err != nil {
+			return err
+		}
+		if _, err = imageRaw.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
 	}
 
+	imageDecoded, _, err := image.Decode(imageRaw)
+	if err == image.ErrFormat {
+		return UnsupportedError(strings.ToLower(filepath.Ext(path)))
+	}
 	if err != nil {
 		return err
 	}
 
 	c.src = imageDecoded
-	c.fontBackground = image.NewRGBA(imageDecoded.Bounds())
+	c.fillFontBackground()
 
 	return nil
 }
@@ -146,14 +783,91 @@ func (c *Context) SetSrcPath(path string) error {
 //
 // Only TTF or TTC formats are supported.
 // From freetype-go docs: "For TrueType Collections, the first font in the collection is parsed"
+//
+// Parsed fonts are cached by absolute path, so loading the same font in many Contexts only reads and parses it
+// once. A font file that has been modified since it was cached is parsed again. See ClearFontCache
 func (c *Context) SetFontPath(path string) error {
-	fontRaw, err := ioutil.ReadFile(path)
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(absPath)
 	if err != nil {
 		return err
 	}
 
-	c.font, err = freetype.ParseFont(fontRaw)
-	return err
+	fontCache.Lock()
+	cached, ok := fontCache.fonts[absPath]
+	fontCache.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) {
+		c.font = cached.font
+		return nil
+	}
+
+	// The file is read and parsed without holding the cache lock so that loading one font does not block loads
+	// of other fonts. If another call cached the same file in the meantime its font is used instead
+	fontRaw, err := readFontFile(absPath)
+	if err != nil {
+		return err
+	}
+	font, err := freetype.ParseFont(fontRaw)
+	if err != nil {
+		return err
+	}
+
+	fontCache.Lock()
+	defer fontCache.Unlock()
+	if cached, ok := fontCache.fonts[absPath]; ok && cached.modTime.Equal(info.ModTime()) {
+		c.font = cached.font
+		return nil
+	}
+	fontCache.fonts[absPath] = cachedFont{font: font, modTime: info.ModTime()}
+	c.font = font
+	return nil
+}
+
+// readFontFile reads font files for SetFontPath. Tests replace it to count file reads
+var readFontFile = ioutil.ReadFile
+
+// cachedFont is a font parsed by SetFontPath along with the modification time of its file
+type cachedFont struct {
+	font    *truetype.Font
+	modTime time.Time
+}
+
+// fontCache holds every font parsed by SetFontPath, keyed by absolute path
+var fontCache = struct {
+	sync.Mutex
+	fonts map[string]cachedFont
+}{fonts: map[string]cachedFont{}}
+
+// ClearFontCache forgets every font parsed by SetFontPath, so the next call for each path reads the file again.
+// Contexts that already have a font set keep using it
+func ClearFontCache() {
+	fontCache.Lock()
+	fontCache.fonts = map[string]cachedFont{}
+	fontCache.Unlock()
+}
+
+// SetFontFromDir loads the first TTF or TTC font, in alphabetical order, found in dir.
+// Sub-directories are not searched. See SetFontPath for more information
+func (c *Context) SetFontFromDir(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		extension := strings.ToLower(filepath.Ext(file.Name()))
+		if extension == ".ttf" || extension == ".ttc" {
+			return c.SetFontPath(filepath.Join(dir, file.Name()))
+		}
+	}
+
+	return fmt.Errorf("no .ttf or .ttc font found in %s", dir)
 }
 
 // SetFont Directly sets the truetype.Font data
@@ -162,6 +876,23 @@ func (c *Context) SetFont(font *truetype.Font) {
 	c.font = font
 }
 
+// CanRender reports whether the font has a glyph for r, so text can be checked for characters that would be
+// drawn as the font's missing glyph box before it is drawn. Returns false if no font is set
+func (c *Context) CanRender(r rune) bool {
+	return c.font != nil && c.glyphIndex(r) != 0
+}
+
+// SetFontVariation would select the instance of a variable font with value on the given axis, e.g. "wght".
+//
+// Note: freetype-go does not read font variation tables, so variable fonts are always rendered with their
+// default instance. This returns ErrVariableFontUnsupported rather than silently ignoring the request
+func (c *Context) SetFontVariation(axis string, value float64) error {
+	if c.font == nil {
+		return ErrNoFont
+	}
+	return ErrVariableFontUnsupported
+}
+
 // setMaxFontSize sets the maximum size the text can be in points.
 //
 // Note: No guerentee is made that the text will be at this size point.
@@ -169,11 +900,53 @@ func (c *Context) SetFont(font *truetype.Font) {
 // within the text box; which is specified in writeText
 func (c *Context) SetMaxFontSize(size int) {
 	c.maxFontSize = int32(size)
+	c.maxFontSizeRel = 0
+}
+
+// SetMinFontSize sets the smallest size WriteLabel shrinks a label to before it cuts the label short with an
+// ellipsis instead. Defaults to 1
+func (c *Context) SetMinFontSize(size int) {
+	c.minFontSize = int32(size)
+}
+
+// SetMaxFontSizePx does the same thing as SetMaxFontSize, except the size is given in pixels instead of points.
+// Pixels and points are related by the DPI, px = pt * dpi / 72, so call SetDPI first if you're changing it
+func (c *Context) SetMaxFontSizePx(px int) {
+	dpi := c.dpi
+	if dpi <= 0 {
+		dpi = DefaultDPI
+	}
+	c.SetMaxFontSize(int(float64(px)*72/dpi + 0.5))
+}
+
+// SetFontSizeRelative sets the maximum font size as a fraction of the source image's height, e.g. 0.1 for
+// 10% of the height, so annotations look the same on images of different sizes. It replaces the size set
+// with SetMaxFontSize
+func (c *Context) SetFontSizeRelative(fraction float64) {
+	c.maxFontSizeRel = fraction
 }
 
-// SetDPI sets the screen resolution in pixels per inch. Defaults to 81.58
+// maxSize returns the maximum font size for the current source image
+func (c *Context) maxSize() int32 {
+	if c.maxFontSizeRel > 0 && c.src != nil {
+		return int32(c.maxFontSizeRel * float64(c.src.Bounds().Dy()))
+	}
+	return c.maxFontSize
+}
+
+// SetDPI sets the screen resolution in pixels per inch. Defaults to DefaultDPI.
+// A dpi of zero or less is ignored, see SetDPIChecked to find out about it
 func (c *Context) SetDPI(dpi float64) {
+	c.SetDPIChecked(dpi)
+}
+
+// SetDPIChecked does the same thing as SetDPI, except it returns ErrInvalidDPI if dpi is zero or less
+func (c *Context) SetDPIChecked(dpi float64) error {
+	if dpi <= 0 || math.IsNaN(dpi) {
+		return ErrInvalidDPI
+	}
 	c.dpi = dpi
+	return nil
 }
 
 // SetLineHeight sets the line height in em units to be used when annotating the image. It scales to the
@@ -184,144 +957,2128 @@ func (c *Context) SetDPI(dpi float64) {
 // Example: If max font size is 80 and lineHeight is set to .5, but it turns out that the
 // Largest font size that can be fitted inside ofthe box is 60, then the line height is actully
 // 30 points, not 40.
+//
+// SetLineHeight and SetLeading both set the space between lines, and whichever was called last wins
 func (c *Context) SetLineHeight(height float64) {
 	c.lineHeight = height
+	c.useLeading = false
 }
 
-// SetFontColor sets a solid color for fonts
-func (c *Context) SetFontColor(rgbaColor Color) {
-	//draw.Draw(c.fontBackground, c.src.Bounds(),
-	//image.NewUniform(rgbaColor), image.ZP, 0)
+// SetLeading sets the space between lines to exactly px pixels on top of the font's natural line height, its
+// ascent plus its descent, regardless of the font size. It's an alternative to the em based SetLineHeight
+func (c *Context) SetLeading(px int32) {
+	c.leading = px
+	c.useLeading = true
+}
 
-	//c.fontBackground = *image.NewUniform(rgbaColor)
-	c.fontColor = image.NewUniform(rgbaColor)
+// lineAdvance returns the distance from one baseline to the next at fontSize, not counting paragraph spacing
+func (c *Context) lineAdvance(fontSize int32) int32 {
+	if c.useLeading {
+		bounds := c.bounds(fontSize)
+		return bounds.YMax - bounds.YMin + c.leading
+	}
+	return int32(c.lineHeight*c.em(fontSize) + c.em(fontSize))
 }
 
-// SetFontImage sets an image as the color for text
-func (c *Context) SetFontImage(backgroundImage draw.Image) {
-	draw.Draw(c.fontBackground, c.fontBackground.Bounds(), backgroundImage, image.ZP, 0)
+// descentSpace returns the space left below the last baseline so descenders aren't cut off
+func (c *Context) descentSpace(fontSize int32) int32 {
+	if c.useLeading {
+		return -c.bounds(fontSize).YMin
+	}
+	return int32(c.lineHeight * c.em(fontSize))
 }
 
-func (c *Context) SetAlignment(alignment int) {
-	c.alignment = alignment
+// SetParagraphSpacing sets extra space in em units that is added above lines which follow a hard newline,
+// so paragraphs are set apart from lines that were wrapped. Defaults to 0
+func (c *Context) SetParagraphSpacing(em float64) {
+	c.paragraphSpace = em
 }
 
-func (c *Context) wordWidth(word string, isFirstWord bool, fontSize int32) int32 {
-	width := int32(0)
-	wordLen := len(word)
-	for i := 0; i < wordLen; i++ {
-		index := c.font.Index(rune(word[i]))
-		hMetric := c.font.HMetric(fontSize, index)
-		width += hMetric.AdvanceWidth
-		if i == 0 && isFirstWord == true {
-			spaceIndex := c.font.Index(rune(' '))
-			width += c.font.Kerning(fontSize, spaceIndex, index)
-		}
-		if i != wordLen-1 {
-			index2 := c.font.Index(rune(word[i+1]))
-			width += c.font.Kerning(fontSize, index, index2)
-		}
+// SetLineBreakAlgorithm sets how wrapped text is broken into lines. Defaults to Greedy.
+// Balanced is not used when SetCJKBreaking is enabled
+func (c *Context) SetLineBreakAlgorithm(algorithm LineBreakAlgorithm) {
+	c.lineBreaking = algorithm
+}
+
+// SetBreakFunc sets a function that decides whether a line may be broken between the words prev and next,
+// e.g. to keep a number together with its unit. Lines can only be broken at the white space between words, and
+// when fn returns false next stays on the same line even if it overflows the bounding box.
+// Pass nil to allow breaking between any two words, which is the default
+func (c *Context) SetBreakFunc(fn func(prev, next string) bool) {
+	c.breakFunc = fn
+}
+
+// SetTrimTrailingSpace excludes the space that is measured after the last word of each line from the line's width.
+// The width of a line is used when wrapping, aligning and fitting text, so enabling this gives more accurate
+// centering and lets lines fill the bounding box more fully. Disabled by default
+func (c *Context) SetTrimTrailingSpace(trim bool) {
+	c.trimTrailing = trim
+}
+
+// SetClampBox shrinks bounding boxes that extend past the edges of the source image to the part that
+// is inside of it, so text is fitted to the visible area. Disabled by default
+func (c *Context) SetClampBox(clamp bool) {
+	c.clampBox = clamp
+}
+
+// SetBottomPadding sets extra space in pixels that is reserved below the last line when fitting text inside of
+// the bounding box. Increase it if descenders of your font get clipped at the bottom of the box
+func (c *Context) SetBottomPadding(px int32) {
+	c.bottomPadding = px
+}
+
+// SetFontColor sets a solid color for fonts.
+//
+// SetFontColor, SetFontImage, SetFontFillImage and SetFontColorAutoContrast all set what text is filled with,
+// and whichever was called last wins
+func (c *Context) SetFontColor(rgbaColor Color) {
+	c.fontImage = nil
+	c.contrastColors = nil
+	c.fontColor = image.NewUniform(rgbaColor)
+}
+
+// SetFontImage sets an image as the color for text. See SetFontImageMode for how it covers the source
+func (c *Context) SetFontImage(backgroundImage draw.Image) {
+	c.fontImage = backgroundImage
+	c.contrastColors = nil
+	c.fillFontBackground()
+}
+
+// SetFontFillImage sets img as the color for text, tiling it across the source. Unlike SetFontImage, the image
+// is sampled directly while drawing, so no buffer the size of the source is allocated for it
+func (c *Context) SetFontFillImage(img image.Image) {
+	c.fontImage = nil
+	c.contrastColors = nil
+	c.fontColor = tiledImage{img}
+}
+
+// SetFontColorAutoContrast fills text with either light or dark, whichever stands out more against the average
+// brightness of the source under the bounding box. The source is measured every time text is drawn, so it's
+// suited to captions over photos that aren't known ahead of time. See SetFontColor
+func (c *Context) SetFontColorAutoContrast(light, dark Color) {
+	c.fontImage = nil
+	c.fontColor = nil
+	c.contrastColors = []Color{light, dark}
+}
+
+// contrastColor returns whichever of the auto contrast colors differs the most in luminance from the average
+// luminance of the source inside of r, as it is drawn over the background color if it needs one
+func (c *Context) contrastColor(r image.Rectangle) Color {
+	r = r.Intersect(c.src.Bounds())
+	needsBackground := c.needsBackground()
+	// sample a grid of at most 64x64 pixels, which is plenty for an average
+	stepX, stepY := r.Dx()/64+1, r.Dy()/64+1
+	sum, samples := 0.0, 0
+	for y := r.Min.Y; y < r.Max.Y; y += stepY {
+		for x := r.Min.X; x < r.Max.X; x += stepX {
+			col := c.src.At(x, y)
+			if needsBackground {
+				col = over(col, *c.bgColor)
+			}
+			sum += luminance(col)
+			samples++
+		}
+	}
+	light, dark := c.contrastColors[0], c.contrastColors[1]
+	if samples == 0 {
+		return dark
+	}
+	average := sum / float64(samples)
+	if math.Abs(luminance(light)-average) > math.Abs(luminance(dark)-average) {
+		return light
+	}
+	return dark
+}
+
+// over returns col composited over bg, the way draw.Over blends them
+func over(col, bg color.Color) color.Color {
+	r, g, b, a := col.RGBA()
+	bgR, bgG, bgB, bgA := bg.RGBA()
+	under := 0xffff - a
+	return color.RGBA64{
+		uint16(r + bgR*under/0xffff),
+		uint16(g + bgG*under/0xffff),
+		uint16(b + bgB*under/0xffff),
+		uint16(a + bgA*under/0xffff),
+	}
+}
+
+// luminance returns the Rec. 709 luma of col, from 0 to 1
+func luminance(col color.Color) float64 {
+	r, g, b, _ := col.RGBA()
+	return (0.2126*float64(r) + 0.7152*float64(g) + 0.0722*float64(b)) / 0xffff
+}
+
+// SetFontImageMode sets how the font image covers the source when it is smaller or larger than the source.
+// Defaults to Unscaled
+func (c *Context) SetFontImageMode(mode FillMode) {
+	c.fontImageMode = mode
+	c.fillFontBackground()
+}
+
+// SetFontImageInterpolation sets how the font image is resampled when it is scaled by the Stretch fill mode,
+// e.g. xdraw.NearestNeighbor for hard pixel edges or xdraw.CatmullRom for smooth high quality scaling, where
+// xdraw is golang.org/x/image/draw. Defaults to xdraw.BiLinear
+func (c *Context) SetFontImageInterpolation(i xdraw.Interpolator) {
+	c.fontImageScale = i
+	c.fillFontBackground()
+}
+
+// SetFontImageOffset moves the font fill image dx pixels right and dy pixels down relative to the source image,
+// e.g. to line a pattern up with the text. Negative values move it left and up
+func (c *Context) SetFontImageOffset(dx, dy int) {
+	c.fontImageShift = image.Pt(dx, dy)
+}
+
+// fillFontBackground redraws fontBackground from the font image according to the fill mode,
+// and makes it the fill for text. fontBackground is only allocated once there is a font image, and is
+// reused for sources of the same size
+func (c *Context) fillFontBackground() {
+	if c.src == nil || c.fontImage == nil {
+		return
+	}
+	if c.fontBackground == nil || c.fontBackground.Bounds() != c.src.Bounds() {
+		c.fontBackground = image.NewRGBA(c.src.Bounds())
+	} else if c.fontImageMode != Tile && c.fontImageMode != Stretch {
+		// the font image may not cover all of the reused buffer
+		draw.Draw(c.fontBackground, c.fontBackground.Bounds(), image.Transparent, image.ZP, draw.Src)
+	}
+	c.fontColor = c.fontBackground
+
+	dstBounds := c.fontBackground.Bounds()
+	srcBounds := c.fontImage.Bounds()
+	if srcBounds.Empty() {
+		return
+	}
+
+	switch c.fontImageMode {
+	case Tile:
+		for y := dstBounds.Min.Y; y < dstBounds.Max.Y; y += srcBounds.Dy() {
+			for x := dstBounds.Min.X; x < dstBounds.Max.X; x += srcBounds.Dx() {
+				tile := image.Rect(x, y, x+srcBounds.Dx(), y+srcBounds.Dy())
+				draw.Draw(c.fontBackground, tile, c.fontImage, srcBounds.Min, draw.Src)
+			}
+		}
+	case Stretch:
+		interpolator := c.fontImageScale
+		if interpolator == nil {
+			interpolator = xdraw.BiLinear
+		}
+		interpolator.Scale(c.fontBackground, dstBounds, c.fontImage, srcBounds, xdraw.Src, nil)
+	default:
+		draw.Draw(c.fontBackground, dstBounds, c.fontImage, srcBounds.Min, draw.Src)
+	}
+}
+
+// SetTextBackground fills the bounding box with a solid color panel before the text is drawn
+func (c *Context) SetTextBackground(bg Color) {
+	c.SetTextBackgroundRounded(bg, 0)
+}
+
+// SetTextBackgroundRounded does the same thing as SetTextBackground, except the corners of the panel
+// are rounded with the given radius in pixels. The corners are anti-aliased
+func (c *Context) SetTextBackgroundRounded(bg Color, radius int32) {
+	c.textBackground = image.NewUniform(bg)
+	c.textBgRadius = radius
+}
+
+// SetTextBackgroundGradient does the same thing as SetTextBackground, except the panel fades from one color
+// to the other in the given direction, e.g. from at the top edge and to at the bottom edge for GradientVertical
+func (c *Context) SetTextBackgroundGradient(from, to Color, dir GradientDirection) {
+	c.textBackground = &linearGradient{from: from, to: to, dir: dir}
+	c.textBgRadius = 0
+}
+
+func (c *Context) SetAlignment(alignment int) {
+	c.alignment = alignment
+}
+
+// SetAntialias enables or disables anti-aliasing of glyph edges. When disabled, every glyph pixel is either
+// fully covered or not covered at all, which composites cleanly onto paletted or transparent targets.
+// Enabled by default
+func (c *Context) SetAntialias(enabled bool) {
+	c.antialias = enabled
+}
+
+// SetBackdropBlur blurs the source image inside of the bounding box with a Gaussian blur of the given radius
+// in pixels before the text is drawn, like frosted glass, so text stands out over busy images.
+// Defaults to 0, no blur
+func (c *Context) SetBackdropBlur(radius int) {
+	c.backdropBlur = radius
+}
+
+// SetWordHighlight sets the color drawn behind words highlighted by WriteTextHighlighted
+func (c *Context) SetWordHighlight(bg Color) {
+	c.wordHighlight = image.NewUniform(bg)
+}
+
+// SetSupersample renders glyphs at factor times their size and scales them back down before they are drawn
+// onto the source, which gives crisper edges for small text. A factor of 4 is a good choice.
+// Defaults to 1, no supersampling
+func (c *Context) SetSupersample(factor int) {
+	c.supersample = factor
+}
+
+// SetSupersampleFilter sets the filter used to scale supersampled glyphs back down, see SetSupersample. Sharper
+// filters give crisper edges at the cost of some ringing. nil averages each block of pixels, the softest option.
+// Defaults to xdraw.CatmullRom
+func (c *Context) SetSupersampleFilter(i xdraw.Interpolator) {
+	c.sampleFilter = i
+}
+
+// SetAutoExpand grows the annotated image past the edges of the source to fit the whole annotation, instead of
+// cutting off text that doesn't fit on the source, e.g. text bled off the edge with a bounding box at negative
+// coordinates. The new area is filled with the color set by SetExpandColor. The bounds of the annotated image
+// are in the same coordinates as the source, so they can start at negative coordinates. Disabled by default
+func (c *Context) SetAutoExpand(enable bool) {
+	c.autoExpand = enable
+}
+
+// SetExpandColor sets the color that SetAutoExpand fills the area added around the source with. Defaults to
+// transparent
+func (c *Context) SetExpandColor(fill Color) {
+	c.expandColor = fill
+}
+
+// SetBackgroundColor sets a color, like the color of paper, that transparent and translucent pixels of the source
+// are blended onto before the text is drawn. Use it when saving a source with an alpha channel to a format
+// without one, like JPEG, where transparent pixels would otherwise turn black. Sources without transparency
+// are left as they are. Backdrop blur and auto contrast colors work from the source as blended onto the
+// background. With SetInPlace, a source that needs the background is copied rather than modified
+func (c *Context) SetBackgroundColor(bg Color) {
+	c.bgColor = &bg
+}
+
+// SetInPlace makes annotations draw directly onto the source image when it is a draw.Image, such as
+// *image.RGBA, instead of onto a copy of it. This saves an allocation and a full copy per annotation.
+//
+// Note: when enabled, the image passed to SetSrc is modified, and the image returned from WriteText is
+// that same image. Disabled by default
+func (c *Context) SetInPlace(inPlace bool) {
+	c.inPlace = inPlace
+}
+
+// SetTopAlignMode sets what is lined up with the top of the bounding box, which decides how far below the top
+// the first line's baseline is. Defaults to EmTop
+func (c *Context) SetTopAlignMode(mode TopAlign) {
+	c.topAlign = mode
+}
+
+// SetWrap enables or disables wrapping lines that are too wide for the bounding box. With wrapping disabled
+// a new line is only started at a hard newline ("\n"), and the font shrinks until the widest of those lines
+// fits within the width of the bounding box, on top of whatever the fit strategy requires. Enabled by default
+func (c *Context) SetWrap(enabled bool) {
+	c.noWrap = !enabled
+}
+
+// SetAspectLock makes the font size search prefer sizes that keep the shape of wrapped text close to the shape
+// of the bounding box: paragraphs that wrap over more than one line should be no taller, relative to the width of
+// their widest line, than the bounding box is relative to its width. In a wide, short box that favors fewer,
+// wider lines over a tall narrow block. Lines broken with "\n" and paragraphs that fit on a single line are not
+// counted. It is only a preference: if no size keeps the shape, the size is chosen as if the lock were disabled,
+// so it never makes text overflow that would otherwise fit. Disabled by default
+func (c *Context) SetAspectLock(enabled bool) {
+	c.aspectLock = enabled
+}
+
+// SetLineRenderedCallback sets a function that is called after each line is drawn, e.g. to show the text
+// appearing line by line or to time rendering. lineIndex counts from 0 and includes blank lines. img is the
+// image the glyphs are being drawn into, which is the partly annotated destination when the text is drawn
+// straight onto it. When glyphs are rendered into a coverage mask first, for supersampling, gamma, image fills
+// or flipping, img is that *image.Alpha mask instead. img is only valid until the callback returns.
+// Pass nil to remove the callback
+func (c *Context) SetLineRenderedCallback(fn func(lineIndex int, img image.Image)) {
+	c.lineCallback = fn
+}
+
+// SetFitStrategy sets what has to fit inside of the bounding box when choosing a font size. Defaults to FitHeight
+func (c *Context) SetFitStrategy(strategy FitStrategy) {
+	c.fitStrategy = strategy
+}
+
+// SetGamma applies gamma correction to the anti-aliased edges of glyphs before they are drawn. Each edge pixel's
+// coverage is raised to the power of 1/g, so values above 1 make text look heavier and values below 1 make it
+// look thinner. Defaults to 1, no correction
+func (c *Context) SetGamma(g float64) {
+	c.gamma = g
+}
+
+// SetLetterSpacing adds px pixels of space after every glyph. Negative values condense the text, but a glyph's
+// advance is never reduced below 10% of its natural width so glyphs never pile up or reverse. Defaults to 0
+func (c *Context) SetLetterSpacing(px int32) {
+	c.letterSpacing = px
+}
+
+// SetOpacity sets the opacity, from 0 to 1, of the whole annotation, including any background panel and
+// highlights, on top of the alpha of the colors used. Useful for subtle watermarks. Defaults to 1, fully opaque
+func (c *Context) SetOpacity(a float64) {
+	c.opacity = math.Max(0, math.Min(1, a))
+}
+
+// SetClipRect restricts drawing to r, so pixels of the source outside of it are never changed, e.g. to keep an
+// annotation inside of a widget. Pass an empty rectangle to draw anywhere on the source, which is the default
+func (c *Context) SetClipRect(r image.Rectangle) {
+	c.clipRect = r
+}
+
+// SetGlyphByGlyph draws text one glyph at a time instead of a whole line at once. The output is the same for
+// plain text, but it is slower; it is used automatically by the features that need to adjust individual
+// glyphs, such as letter spacing. Disabled by default
+func (c *Context) SetGlyphByGlyph(enable bool) {
+	c.glyphByGlyph = enable
+}
+
+// SetCJKBreaking allows lines to be broken between Chinese, Japanese and Korean characters, which are usually
+// written without spaces, so long runs of them wrap instead of overflowing. Latin words are still only broken
+// at white space. Disabled by default
+func (c *Context) SetCJKBreaking(enable bool) {
+	c.cjkBreaking = enable
+}
+
+// SetReservedRegion keeps text clear of r, in source image pixels, e.g. where a QR code will be pasted later.
+// Lines that would overlap it are shortened to end before it, or start after it when there is more room on
+// its right, so the text flows around it. A word that is too wide for the space left overflows into it, unless
+// the fit strategy or SetWrap requires lines to fit across, in which case the font shrinks until it fits beside
+// the region. Works together with SetLineWidthFunc. Pass an empty Rectangle to remove the region
+func (c *Context) SetReservedRegion(r Rectangle) {
+	c.reserved = r
+}
+
+// SetLineWidthFunc sets a function that returns the width available to each line, by its index from 0, instead
+// of every line having the width of the bounding box. Lines still start at the left edge of the bounding box, so
+// this makes a ragged right edge, e.g. to flow text around an image. Centered and justified lines use their own
+// width. Pass nil to go back to the width of the bounding box
+func (c *Context) SetLineWidthFunc(fn func(lineIndex int) int32) {
+	c.lineWidthFunc = fn
+}
+
+// SetFlip mirrors the text horizontally, vertically or both, for reflections or text that has to read correctly
+// from the other side of a transparent surface. The text is mirrored within the bounding box, or within the
+// whole image for DrawLinesAt and WriteLine, which have no bounding box. Word highlights are mirrored along with
+// the text, the text background and fill image are not
+func (c *Context) SetFlip(horizontal, vertical bool) {
+	c.flipH = horizontal
+	c.flipV = vertical
+}
+
+// SetFontSizeTolerance lets the search for the largest font size that fits stop once it is within points of
+// it, which saves iterations for large bounding boxes where a point or two isn't noticeable. The chosen size
+// always fits, but may be up to points smaller than the largest size that does. The default is 1, which
+// always finds the largest size
+func (c *Context) SetFontSizeTolerance(points int32) {
+	if points < 1 {
+		points = 1
+	}
+	c.tolerance = points
+}
+
+// SetOriginMode sets which point of the text the position passed to WriteLine refers to. The default is
+// OriginBaseline. WriteText is not affected, its bounding box already positions the top of the text
+func (c *Context) SetOriginMode(mode OriginMode) {
+	c.originMode = mode
+}
+
+// SetDeterministic makes the rendered output byte for byte the same on every platform, e.g. for comparing
+// against golden images in tests. Glyphs are rasterized at the DPI rounded to a whole number, so the glyph scale
+// is computed exactly, and SetSubPixel is ignored, so lines start on whole pixels. Gamma correction, backdrop
+// blur and auto contrast colors use floating point functions that may still differ in the last bit between
+// platforms and should be left off for stable output. Disabled by default
+func (c *Context) SetDeterministic(enable bool) {
+	c.deterministic = enable
+}
+
+// pinDPI returns the DPI to rasterize glyphs at, see SetDeterministic
+func (c *Context) pinDPI(dpi float64) float64 {
+	if c.deterministic {
+		return math.Max(1, math.Floor(dpi+0.5))
+	}
+	return dpi
+}
+
+// SetMaxPixels limits the source images that can be annotated to n pixels. Annotating a larger source, or
+// loading one with SetSrcPath, returns ErrTooManyPixels instead of allocating buffers the size of the image,
+// which guards servers against running out of memory on huge uploads. 0, the default, means no limit
+func (c *Context) SetMaxPixels(n int) {
+	c.maxPixels = n
+}
+
+// checkPixels returns ErrTooManyPixels if bounds has more pixels than allowed by SetMaxPixels
+func (c *Context) checkPixels(bounds image.Rectangle) error {
+	if c.maxPixels > 0 && int64(bounds.Dx())*int64(bounds.Dy()) > int64(c.maxPixels) {
+		return ErrTooManyPixels
+	}
+	return nil
+}
+
+// SetSmartTypography replaces straight quotes with curly quotes, double hyphens with em dashes and three dots
+// with an ellipsis before text is laid out. Disabled by default
+func (c *Context) SetSmartTypography(enable bool) {
+	c.smartTypo = enable
+}
+
+// smartReplacer replaces the character sequences that SetSmartTypography substitutes, other than quotes
+var smartReplacer = strings.NewReplacer("...", "\u2026", "--", "\u2014")
+
+// smarten applies the substitutions of SetSmartTypography to text. A quote opens when it's at the start of the
+// text or follows white space or an opening bracket, and closes otherwise, which also turns apostrophes into
+// right single quotes
+func smarten(text string) string {
+	text = smartReplacer.Replace(text)
+	if !strings.ContainsAny(text, "\"'") {
+		return text
+	}
+	runes := []rune(text)
+	for i, r := range runes {
+		if r != '"' && r != '\'' {
+			continue
+		}
+		opening := i == 0 || unicode.IsSpace(runes[i-1]) || strings.ContainsRune("([{\u2014", runes[i-1])
+		switch {
+		case r == '"' && opening:
+			runes[i] = '\u201c'
+		case r == '"':
+			runes[i] = '\u201d'
+		case opening:
+			runes[i] = '\u2018'
+		default:
+			runes[i] = '\u2019'
+		}
+	}
+	return string(runes)
+}
+
+// SetRuneMapping draws the glyph of m[r] wherever the rune r appears in text, e.g. to type icons of an icon font
+// that live in the private use area with ordinary characters. Text is measured with the mapped glyphs as well.
+// m is copied, so changing it afterwards has no effect. Pass nil to draw every rune as itself
+func (c *Context) SetRuneMapping(m map[rune]rune) {
+	if len(m) == 0 {
+		c.runeMap = nil
+		return
+	}
+	c.runeMap = make(map[rune]rune, len(m))
+	for from, to := range m {
+		c.runeMap[from] = to
+	}
+}
+
+// SetKerningMode sets how the spacing between pairs of glyphs is adjusted, e.g. KernOff for fonts with broken
+// kerning data that makes spacing uneven. Defaults to KernNative
+func (c *Context) SetKerningMode(mode KerningMode) {
+	c.kerning = mode
+}
+
+// SetSubPixel enables sub-pixel positioning of lines. When enabled, centered lines are not rounded to
+// whole pixels before being drawn, which gives more accurate centering of narrow text. Disabled by default
+func (c *Context) SetSubPixel(enable bool) {
+	c.subPixel = enable
+}
+
+// SetBaselineSnap sets whether the baseline of every line is rounded to a whole pixel, which keeps horizontal
+// strokes crisp. With snapping disabled and SetSubPixel enabled, lines are spaced exactly by the line height
+// instead, and each baseline may fall between pixels. Baselines are always snapped without sub-pixel
+// positioning, or in deterministic mode. Enabled by default
+func (c *Context) SetBaselineSnap(enabled bool) {
+	c.baselineSnap = enabled
+}
+
+func (c *Context) wordWidth(word string, isFirstWord bool, fontSize int32) int32 {
+	width := c.runesWidth([]rune(word), fontSize)
+	if isFirstWord && len(word) > 0 {
+		first, _ := utf8.DecodeRuneInString(word)
+		width += toPixels(c.kern(c.layoutScale(fontSize), c.glyphIndex(' '), c.glyphIndex(first)))
+	}
+	return width
+}
+
+// isMark reports whether r is a combining mark, which is drawn over the character before it
+// rather than after it
+func isMark(r rune) bool {
+	return unicode.Is(unicode.Mn, r)
+}
+
+// shaper returns the Shaper for the current font, making a new one when the font has changed
+func (c *Context) shaper() *Shaper {
+	if c.fontShaper == nil || c.fontShaper.font != c.font {
+		c.fontShaper = NewShaper(c.font)
+	}
+	return c.fontShaper
+}
+
+// mapRune returns the rune that is drawn for r, see SetRuneMapping
+func (c *Context) mapRune(r rune) rune {
+	if mapped, ok := c.runeMap[r]; ok {
+		return mapped
+	}
+	return r
+}
+
+// glyphIndex returns the index of the glyph that is drawn for r
+func (c *Context) glyphIndex(r rune) truetype.Index {
+	return c.font.Index(c.mapRune(r))
+}
+
+// kern returns the kerning between the glyphs at a and b at scale, following the kerning mode
+func (c *Context) kern(scale int32, a, b truetype.Index) int32 {
+	if c.kerning == KernOff {
+		return 0
+	}
+	return c.font.Kerning(scale, a, b)
+}
+
+// spacedAdvance returns a glyph advance with the letter spacing added, but no less than 10% of advance
+func (c *Context) spacedAdvance(advance int32) int32 {
+	spaced := advance + c.letterSpacing
+	if floor := advance / 10; spaced < floor {
+		return floor
+	}
+	return spaced
+}
+
+// layoutScale returns the 26.6 fixed point scale that glyphs of fontSize are measured at, which is the scale
+// freetype draws them at with the DPI set with SetDPI
+func (c *Context) layoutScale(fontSize int32) int32 {
+	return int32(float64(fontSize) * c.pinDPI(c.dpi) * 64 / 72)
+}
+
+// em returns the size of fontSize in pixels
+func (c *Context) em(fontSize int32) float64 {
+	return float64(c.layoutScale(fontSize)) / 64
+}
+
+// bounds returns the bounding box of all of the font's glyphs at fontSize in pixels, rounded outwards
+func (c *Context) bounds(fontSize int32) truetype.Bounds {
+	b := c.font.Bounds(c.layoutScale(fontSize))
+	return truetype.Bounds{XMin: b.XMin >> 6, YMin: b.YMin >> 6, XMax: (b.XMax + 63) >> 6, YMax: (b.YMax + 63) >> 6}
+}
+
+// toPixels rounds a 26.6 fixed point length to the nearest whole pixel, the same way freetype rounds the
+// advances and kerning of hinted glyphs
+func toPixels(v int32) int32 {
+	return (v + 32) >> 6
+}
+
+// glyphAdvance returns the advance of the glyph at index in pixels at the 26.6 scale, with the letter spacing
+// added
+func (c *Context) glyphAdvance(index truetype.Index, scale int32) int32 {
+	return c.spacedAdvance(toPixels(c.shaper().advance(index, scale)))
+}
+
+// runesWidth returns the advance width of runes at fontSize in pixels, including kerning between them and letter
+// spacing. It matches how far the pen moves when the runes are drawn
+func (c *Context) runesWidth(runes []rune, fontSize int32) int32 {
+	scale := c.layoutScale(fontSize)
+	width := int32(0)
+	prev, hasPrev := truetype.Index(0), false
+	for _, r := range runes {
+		// combining marks sit over the previous character, so they take up no width
+		if isMark(r) {
+			continue
+		}
+		index := c.glyphIndex(r)
+		if hasPrev {
+			width += toPixels(c.kern(scale, prev, index))
+		}
+		width += c.glyphAdvance(index, scale)
+		prev, hasPrev = index, true
+	}
+	return width
+}
+
+// TruncateToWidth returns the longest prefix of s that, followed by ellipsis, fits within maxWidth at fontSize.
+// If all of s fits, it is returned unchanged. s is cut between runes and never between a base character
+// and the combining marks that follow it. s is returned unchanged if no font is set
+func (c *Context) TruncateToWidth(s string, maxWidth int32, fontSize int32, ellipsis string) string {
+	if c.font == nil {
+		return s
+	}
+	runes := []rune(s)
+	if c.runesWidth(runes, fontSize) <= maxWidth {
+		return s
+	}
+	budget := maxWidth - c.runesWidth([]rune(ellipsis), fontSize)
+	for n := len(runes) - 1; n > 0; n-- {
+		if unicode.Is(unicode.Mn, runes[n]) {
+			continue
+		}
+		if c.runesWidth(runes[:n], fontSize) <= budget {
+			return string(runes[:n]) + ellipsis
+		}
+	}
+	return ellipsis
+}
+
+func (c *Context) WriteText(text string, boundingBox Rectangle) (error, image.Image) {
+	result, err := c.Render(text, boundingBox)
+	if err != nil {
+		return err, nil
+	}
+	return nil, result.Image
+}
+
+// Render does the same thing as WriteText, but also reports how the text was fitted inside of the bounding box
+func (c *Context) Render(text string, boundingBox Rectangle) (*Result, error) {
+	return c.render(text, boundingBox, c.dpi)
+}
+
+// RenderMask lays out text inside of boundingBox the same way WriteText does, and returns only the coverage of
+// the glyphs, without any color or source image. No source image needs to be set. The mask covers the bounding
+// box, in source image pixel coordinates, so it can be composited with draw.DrawMask or used as a clip directly
+func (c *Context) RenderMask(text string, boundingBox Rectangle) (*image.Alpha, error) {
+	if c.font == nil {
+		return nil, ErrNoFont
+	}
+	if boundingBox.Width <= 0 || boundingBox.Height <= 0 {
+		return nil, ErrInvalidBox
+	}
+	fit, lines, fontSize, _ := c.calculateSize(text, boundingBox, c.maxSize(), -1, 0)
+	if !fit {
+		return nil, ErrTextOverflow
+	}
+	c.fontSize = fontSize
+
+	scale := 1
+	if c.supersample > 1 {
+		scale = c.supersample
+	}
+	region := boundingBox.Rect()
+	mask := image.NewAlpha(image.Rect(region.Min.X*scale, region.Min.Y*scale, region.Max.X*scale, region.Max.Y*scale))
+	renderDPI := c.pinDPI(c.dpi) * float64(scale)
+
+	imageContext := freetype.NewContext()
+	imageContext.SetFont(c.font)
+	imageContext.SetDPI(renderDPI)
+	imageContext.SetSrc(image.Opaque)
+	imageContext.SetDst(mask)
+	imageContext.SetClip(mask.Bounds())
+	imageContext.SetHinting(freetype.FullHinting)
+	imageContext.SetFontSize(float64(fontSize))
+	for _, line := range lines {
+		var err error
+		if line.extraSpace > 0 {
+			_, err = c.drawJustified(imageContext, line, fontSize, renderDPI, scale)
+		} else {
+			_, err = c.drawString(imageContext, line.joined(), line.origin(scale), fontSize, renderDPI, scale)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if scale > 1 {
+		mask = c.downsample(mask, scale)
+	}
+	c.adjustCoverage(mask)
+	if c.flipH || c.flipV {
+		mask = flipAlpha(mask, region, c.flipH, c.flipV)
+	}
+	return mask, nil
+}
+
+// WriteTextOnto annotates dst, such as a frame of an animated GIF, in place. dst becomes the source image.
+// The text is drawn in full color and then every pixel is mapped to the nearest color of dst's palette.
+//
+// With SetInPlace enabled the text is drawn straight onto dst instead, so each drawing step is mapped to the
+// palette as it happens. That skips a full copy of the frame each way, at some cost to antialiasing quality
+func (c *Context) WriteTextOnto(dst *image.Paletted, text string, boundingBox Rectangle) error {
+	c.SetSrc(dst)
+	result, err := c.Render(text, boundingBox)
+	if err != nil {
+		return err
+	}
+	// when drawn in place the result already is dst, copying it onto itself would be wasted work
+	if drawn, ok := result.Image.(*image.Paletted); !ok || drawn != dst {
+		draw.Draw(dst, dst.Bounds(), result.Image, dst.Bounds().Min, draw.Src)
+	}
+	c.src = dst
+	return nil
+}
+
+// WriteCaption reserves a bar height pixels tall across the top or bottom of the source image, fills it with bg,
+// and draws text centered inside of it at the largest size that fits. The text, descenders included, is kept
+// inside of the bar. The rest of the Context's settings are used as they are
+func (c *Context) WriteCaption(text string, pos CaptionPosition, height int32, bg Color) (image.Image, error) {
+	if c.font == nil {
+		return nil, ErrNoFont
+	}
+	if c.src == nil {
+		return nil, ErrNoSource
+	}
+	bounds := c.src.Bounds()
+	bar := RectangleOf(bounds)
+	bar.Height = height
+	if pos == CaptionBottom {
+		bar.Y = int32(bounds.Max.Y) - height
+	}
+
+	caption := c.Clone()
+	caption.SetAlignment(CENTERED)
+	caption.SetTextBackground(bg)
+	// room for descenders at the largest size is enough for any size the text is shrunk to
+	caption.SetBottomPadding(c.bottomPadding - c.bounds(c.maxSize()).YMin)
+	clip := bar.Rect()
+	if !c.clipRect.Empty() {
+		clip = clip.Intersect(c.clipRect)
+		if clip.Empty() {
+			// none of the bar may be drawn on
+			return c.src, nil
+		}
+	}
+	caption.SetClipRect(clip)
+	result, err := caption.Render(text, bar)
+	if err != nil {
+		return nil, err
+	}
+	c.src = result.Image
+	return result.Image, nil
+}
+
+// WriteTextTo does the same thing as WriteText, except the annotated image is encoded in format, one of
+// SupportedFormats, straight into w. The encoded image is streamed out as it is encoded rather than built up in
+// memory first, which matters for very large images
+func (c *Context) WriteTextTo(w io.Writer, format string, text string, boundingBox Rectangle) error {
+	imgFormat, ok := formatForName(format)
+	if !ok {
+		return UnsupportedError(format)
+	}
+	result, err := c.Render(text, boundingBox)
+	if err != nil {
+		return err
+	}
+	encoder := &Encoder{img: result.Image, format: imgFormat}
+	_, err = encoder.WriteTo(w)
+	return err
+}
+
+// WriteTemplate does the same thing as WriteText, except the text is tmpl with its {{key}} placeholders filled
+// in from data first, e.g. for certificates or tickets made from the same template. tmpl is a text/template, so
+// {{.key}} works as well. A placeholder without a value in data is an error rather than being left blank
+func (c *Context) WriteTemplate(tmpl string, data map[string]interface{}, boundingBox Rectangle) (image.Image, error) {
+	// {{key}} is a function call to text/template, so every key gets a function returning its value
+	funcs := template.FuncMap{}
+	for key, value := range data {
+		if !isIdentifier(key) {
+			// only reachable as {{index . "key"}}, and Funcs panics on names like this
+			continue
+		}
+		value := value
+		funcs[key] = func() interface{} { return value }
+	}
+	t, err := template.New("annotation").Funcs(funcs).Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+	var text strings.Builder
+	if err = t.Execute(&text, data); err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+
+	result, err := c.Render(text.String(), boundingBox)
+	if err != nil {
+		return nil, err
+	}
+	return result.Image, nil
+}
+
+// isIdentifier reports whether s is a valid Go identifier, which text/template requires of function names
+func isIdentifier(s string) bool {
+	for i, r := range s {
+		if !(r == '_' || unicode.IsLetter(r) || i > 0 && unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// WriteMetric draws value followed by unit as big as possible inside of the bounding box, for big number cards
+// on dashboards. Before the font is shrunk to fit, more compact ways of writing value are tried, going from
+// "1,234,567" to "1.23M", "1.2M" and "1M", and the first one that fits at the max font size is drawn. If
+// none of them do, the one that fits at the largest font size is drawn. The metric is kept on one line, which
+// has to fit across the box
+func (c *Context) WriteMetric(value float64, unit string, boundingBox Rectangle) (image.Image, error) {
+	boundingBox, err := c.checkReady(boundingBox)
+	if err != nil {
+		return nil, err
+	}
+	defer func(noWrap bool) {
+		c.noWrap = noWrap
+	}(c.noWrap)
+	c.noWrap = true
+
+	best, bestSize := "", int32(0)
+	for _, candidate := range metricCandidates(value) {
+		if unit != "" {
+			candidate += " " + unit
+		}
+		_, _, fontSize, _ := c.calculateSize(candidate, boundingBox, c.maxSize(), -1, 0)
+		if fontSize > bestSize {
+			best, bestSize = candidate, fontSize
+		}
+		if fontSize == c.maxSize() {
+			break
+		}
+	}
+
+	result, err := c.render(best, boundingBox, c.dpi)
+	if err != nil {
+		return nil, err
+	}
+	return result.Image, nil
+}
+
+// metricCandidates returns the ways WriteMetric can write value, from the most precise to the most compact
+func metricCandidates(value float64) []string {
+	candidates := []string{}
+	if value == math.Trunc(value) {
+		candidates = append(candidates, groupThousands(strconv.FormatFloat(value, 'f', 0, 64)))
+	} else {
+		candidates = append(candidates, groupThousands(trimZeros(strconv.FormatFloat(value, 'f', 2, 64))))
+	}
+
+	suffixes := []string{"", "k", "M", "G", "T", "P"}
+	for decimals := 2; decimals >= 0; decimals-- {
+		scaled, suffix := value, 0
+		// scale down until the rounded number is below 1000, so 999,999 becomes 1M rather than 1000k
+		for suffix < len(suffixes)-1 && math.Abs(roundTo(scaled, decimals)) >= 1000 {
+			scaled /= 1000
+			suffix++
+		}
+		if suffix == 0 {
+			continue
+		}
+		candidate := trimZeros(strconv.FormatFloat(scaled, 'f', decimals, 64)) + suffixes[suffix]
+		if candidate != candidates[len(candidates)-1] {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
+
+// roundTo rounds v to the given number of decimals
+func roundTo(v float64, decimals int) float64 {
+	pow := math.Pow(10, float64(decimals))
+	return math.Floor(v*pow+0.5) / pow
+}
+
+// trimZeros removes trailing zeros after the decimal point of a formatted number, and the point if nothing is
+// left after it
+func trimZeros(number string) string {
+	if !strings.Contains(number, ".") {
+		return number
+	}
+	return strings.TrimRight(strings.TrimRight(number, "0"), ".")
+}
+
+// groupThousands adds commas between every three digits of the integer part of a formatted number
+func groupThousands(number string) string {
+	sign := ""
+	if strings.HasPrefix(number, "-") {
+		sign, number = "-", number[1:]
+	}
+	integer, fraction := number, ""
+	if dot := strings.Index(number, "."); dot != -1 {
+		integer, fraction = number[:dot], number[dot:]
+	}
+	for i := len(integer) - 3; i > 0; i -= 3 {
+		integer = integer[:i] + "," + integer[i:]
+	}
+	return sign + integer + fraction
+}
+
+// RenderResponsive annotates the source scaled to each of widths, keeping its aspect ratio, for responsive image
+// sets. The text is laid out inside of boundingBox on each scaled source, and the max font size is scaled along
+// with the source unless it was set with SetFontSizeRelative. The source and settings of c are left untouched.
+// The images are returned by width
+func (c *Context) RenderResponsive(text string, boundingBox RectangleRel, widths []int) (map[int]image.Image, error) {
+	if c.src == nil {
+		return nil, ErrNoSource
+	}
+	srcBounds := c.src.Bounds()
+	if srcBounds.Empty() {
+		return nil, ErrInvalidBox
+	}
+
+	images := map[int]image.Image{}
+	for _, width := range widths {
+		if width <= 0 {
+			return nil, fmt.Errorf("invalid width %d", width)
+		}
+		ratio := float64(width) / float64(srcBounds.Dx())
+		height := int(float64(srcBounds.Dy())*ratio + 0.5)
+		if height < 1 {
+			height = 1
+		}
+		scaled := newImageLike(c.src, image.Rect(0, 0, width, height))
+		xdraw.CatmullRom.Scale(scaled, scaled.Bounds(), c.src, srcBounds, xdraw.Src, nil)
+
+		clone := c.Clone()
+		clone.SetSrc(scaled)
+		if clone.maxFontSizeRel == 0 {
+			clone.maxFontSize = larger(1, int32(float64(c.maxFontSize)*ratio+0.5))
+		}
+		result, err := clone.Render(text, boundingBox.Abs(scaled.Bounds()))
+		if err != nil {
+			return nil, err
+		}
+		images[width] = result.Image
+	}
+	return images, nil
+}
+
+// WriteTextDPI does the same thing as WriteText, except the text is rendered at dpi instead of the DPI
+// set on the Context with SetDPI. Useful for rendering the same annotation at several resolutions
+func (c *Context) WriteTextDPI(text string, boundingBox Rectangle, dpi float64) (image.Image, error) {
+	if dpi <= 0 || math.IsNaN(dpi) {
+		return nil, ErrInvalidDPI
+	}
+	result, err := c.render(text, boundingBox, dpi)
+	if err != nil {
+		return nil, err
+	}
+	return result.Image, nil
+}
+
+func (c *Context) render(text string, boundingBox Rectangle, dpi float64) (*Result, error) {
+	boundingBox, err := c.checkReady(boundingBox)
+	if err != nil {
+		return nil, err
+	}
+	// nothing to draw for empty or whitespace only text, so don't bother searching for a font size
+	if strings.TrimSpace(text) == "" {
+		return &Result{Image: c.copySrc(), FontSize: c.maxSize(), FitAtMax: true}, nil
+	}
+	// the text is laid out at the resolution it's drawn at, so glyphs take up the space they were measured for
+	if dpi != c.dpi {
+		defer func(dpi float64) {
+			c.dpi = dpi
+		}(c.dpi)
+		c.dpi = dpi
+	}
+	fit, lines, fontSize, iterations := c.calculateSize(text, boundingBox, c.maxSize(), -1, 0)
+	if !fit {
+		return nil, ErrTextOverflow
+	}
+	c.fontSize = fontSize
+	err, img := c.drawLines(lines, boundingBox, fontSize, dpi)
+	lineEnds := make([]image.Point, len(lines))
+	for i, line := range lines {
+		lineEnds[i] = line.end
+	}
+	return &Result{
+		Image:      img,
+		FontSize:   fontSize,
+		FitAtMax:   fontSize == c.maxSize(),
+		Iterations: iterations,
+		LineEnds:   lineEnds,
+	}, err
+}
+
+// WriteLine draws text as a single line whose baseline starts at x, y. The text is not wrapped or
+// resized to fit anything, and is clipped to the source image. See SetOriginMode to position the text by
+// its top-left corner instead
+func (c *Context) WriteLine(text string, x, y int32, fontSize int32) (image.Image, error) {
+	if c.originMode == OriginTopLeft && c.font != nil {
+		// the ascent at the DPI the text is drawn at
+		y += c.bounds(fontSize).YMax
+	}
+	return c.DrawLinesAt([]Line{{Words: []string{text}, XPos: x, YPos: y}}, fontSize)
+}
+
+// DrawImageAt composites overlay, such as a logo, onto the source image with its top-left corner at x, y.
+// opacity ranges from 0, invisible, to 1, opaque, and is combined with the overlay's own alpha. The overlay is
+// clipped to the source image and the clip rect, and the result becomes the source for the next annotation
+func (c *Context) DrawImageAt(overlay image.Image, x, y int32, opacity float64) (image.Image, error) {
+	if c.src == nil {
+		return nil, ErrNoSource
+	}
+	opacity = math.Max(0, math.Min(1, opacity))
+
+	var dst draw.Image
+	if srcImage, ok := c.src.(draw.Image); ok && c.inPlace && !c.needsBackground() {
+		dst = srcImage
+	} else {
+		dst = c.copySrc()
+	}
+
+	overlayBounds := overlay.Bounds()
+	r := overlayBounds.Sub(overlayBounds.Min).Add(image.Pt(int(x), int(y))).Intersect(dst.Bounds())
+	if !c.clipRect.Empty() {
+		r = r.Intersect(c.clipRect)
+	}
+	sp := overlayBounds.Min.Add(r.Min.Sub(image.Pt(int(x), int(y))))
+	alpha := image.NewUniform(color.Alpha16{uint16(opacity * 0xffff)})
+	draw.DrawMask(dst, r, overlay, sp, alpha, image.ZP, draw.Over)
+
+	c.src = dst
+	return dst, nil
+}
+
+// WriteLabel draws text on a single line inside of the bounding box, for chips and badges, and returns the font
+// size it was drawn at. The largest font size up to the max font size at which the line fits both the width and
+// the height of the box is chosen. If the line doesn't fit even at the size set with SetMinFontSize, it is drawn
+// at that size and cut short with an ellipsis. ErrTextOverflow is returned if the box isn't even tall enough for
+// a line at that size. Newlines in text are drawn as spaces
+func (c *Context) WriteLabel(text string, boundingBox Rectangle) (image.Image, int32, error) {
+	boundingBox, err := c.checkReady(boundingBox)
+	if err != nil {
+		return nil, 0, err
+	}
+	text = strings.Join(strings.FieldsFunc(text, isBreakingSpace), " ")
+
+	fits := func(fontSize int32) bool {
+		return c.runesWidth([]rune(text), fontSize) <= boundingBox.Width &&
+			c.firstBaseline(fontSize)+c.descentSpace(fontSize) <= boundingBox.Height
+	}
+	minSize := larger(1, c.minFontSize)
+	fontSize, fit := c.largestFit(fits)
+	if fontSize < minSize || !fit {
+		fontSize = minSize
+		if c.firstBaseline(fontSize)+c.descentSpace(fontSize) > boundingBox.Height {
+			return nil, 0, ErrTextOverflow
+		}
+		text = c.TruncateToWidth(text, boundingBox.Width, fontSize, "\u2026")
+	}
+	c.fontSize = fontSize
+
+	width := c.runesWidth([]rune(text), fontSize)
+	line := &Line{Words: []string{text}, currWidth: width, width: width, ParagraphEnd: true}
+	lines, _ := c.calculateTextLineDimentions(boundingBox, []*Line{line}, fontSize)
+	err, img := c.drawLines(lines, boundingBox, fontSize, c.dpi)
+	return img, fontSize, err
+}
+
+// WriteTextHighlighted does the same thing as WriteText, except a highlight is drawn behind the words for
+// which highlight is true, like a highlighter pen. Words are indexed from 0 in the order they appear in text,
+// separated by white space. See SetWordHighlight for the color of the highlight
+func (c *Context) WriteTextHighlighted(text string, boundingBox Rectangle, highlight map[int]bool) (image.Image, error) {
+	boundingBox, err := c.checkReady(boundingBox)
+	if err != nil {
+		return nil, err
+	}
+	fit, lines, fontSize, _ := c.calculateSize(text, boundingBox, c.maxSize(), -1, 0)
+	if !fit {
+		return nil, ErrTextOverflow
+	}
+	c.fontSize = fontSize
+
+	wordIndex := 0
+	for _, line := range lines {
+		line.highlighted = make([]bool, len(line.Words))
+		for j := range line.Words {
+			line.highlighted[j] = highlight[wordIndex]
+			wordIndex++
+		}
+	}
+
+	err, img := c.drawLines(lines, boundingBox, fontSize, c.dpi)
+	return img, err
+}
+
+// WriteTextColumns does the same thing as WriteText, except the text flows across columns of equal width inside
+// of the bounding box, like a newspaper, with gutter pixels between each column. The font size is chosen so all
+// of the text fits across the columns. If it doesn't fit even at the smallest size, ErrTextOverflow is returned
+func (c *Context) WriteTextColumns(text string, boundingBox Rectangle, columns int, gutter int32) (image.Image, error) {
+	boundingBox, err := c.checkReady(boundingBox)
+	if err != nil {
+		return nil, err
+	}
+	if columns < 1 {
+		columns = 1
+	}
+
+	fontSize, fit := c.largestFit(func(fontSize int32) bool {
+		_, fits := c.layoutColumns(text, boundingBox, columns, gutter, fontSize)
+		return fits
+	})
+	if !fit {
+		return nil, ErrTextOverflow
+	}
+
+	lines, _ := c.layoutColumns(text, boundingBox, columns, gutter, fontSize)
+	c.fontSize = fontSize
+	err, img := c.drawLines(lines, boundingBox, fontSize, c.dpi)
+	return img, err
+}
+
+// largestFit binary searches for the largest font size up to the max font size for which fits returns true.
+// It returns 1 and false if nothing fits
+func (c *Context) largestFit(fits func(fontSize int32) bool) (int32, bool) {
+	low, high := int32(1), c.maxSize()
+	for high-low >= larger(c.tolerance, 1) {
+		mid := (low + high + 1) / 2
+		if fits(mid) {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	// sizes above 1 are only ever kept once they're known to fit
+	return low, low > 1 || fits(low)
+}
+
+// WriteList draws each of items inside of the bounding box as a list item with marker in front of it. Wrapped
+// lines of an item are indented past the widest marker so they line up under the item's text, not the marker.
+// The font size is chosen so all of the items fit, the same way WriteText does
+func (c *Context) WriteList(items []string, boundingBox Rectangle, marker ListMarker) (image.Image, error) {
+	boundingBox, err := c.checkReady(boundingBox)
+	if err != nil {
+		return nil, err
+	}
+
+	fontSize, fit := c.largestFit(func(fontSize int32) bool {
+		_, fits := c.layoutList(items, boundingBox, marker, fontSize)
+		return fits
+	})
+	if !fit {
+		return nil, ErrTextOverflow
+	}
+
+	lines, _ := c.layoutList(items, boundingBox, marker, fontSize)
+	c.fontSize = fontSize
+	err, img := c.drawLines(lines, boundingBox, fontSize, c.dpi)
+	return img, err
+}
+
+// layoutList wraps and positions list items along with their markers at fontSize, and reports whether they fit
+func (c *Context) layoutList(items []string, boundingBox Rectangle, marker ListMarker, fontSize int32) ([]*Line, bool) {
+	// every item is indented by the same amount so their text lines up
+	indent := int32(0)
+	for i := range items {
+		indent = larger(indent, c.runesWidth([]rune(marker.forItem(i)), fontSize))
+	}
+	indent += c.wordWidth(" ", false, fontSize)
+
+	textBox := boundingBox
+	textBox.X += indent
+	textBox.Width -= indent
+
+	lines := []*Line{}
+	firstLines := make([]int, len(items))
+	for i, item := range items {
+		firstLines[i] = len(lines)
+		lines = append(lines, c.createTextLines(item, textBox, fontSize)...)
+	}
+	lines, totalHeight := c.calculateTextLineDimentions(textBox, lines, fontSize)
+	fits := textBox.Width > 0 && c.fits(lines, totalHeight, textBox, fontSize)
+
+	for i, first := range firstLines {
+		markerText := marker.forItem(i)
+		lines = append(lines, &Line{
+			Words:        []string{markerText},
+			XPos:         boundingBox.X,
+			YPos:         lines[first].YPos,
+			width:        c.runesWidth([]rune(markerText), fontSize),
+			ParagraphEnd: true,
+		})
+	}
+	return lines, fits
+}
+
+// layoutColumns wraps and positions text across columns at fontSize, and reports whether it all fits
+func (c *Context) layoutColumns(text string, boundingBox Rectangle, columns int, gutter int32, fontSize int32) ([]*Line, bool) {
+	columnWidth := (boundingBox.Width - gutter*int32(columns-1)) / int32(columns)
+	column := Rectangle{X: boundingBox.X, Y: boundingBox.Y, Width: columnWidth, Height: boundingBox.Height}
+	lines := c.createTextLines(text, column, fontSize)
+
+	fits := true
+	start := 0
+	for k := 0; k < columns && start < len(lines); k++ {
+		column.X = boundingBox.X + int32(k)*(columnWidth+gutter)
+		end := start + 1
+		if k == columns-1 {
+			// whatever is left overflows the last column
+			end = len(lines)
+		} else {
+			for end < len(lines) && c.linesHeight(column, lines[start:end+1], fontSize) <= column.Height {
+				end++
+			}
+		}
+		if c.linesHeight(column, lines[start:end], fontSize) > column.Height {
+			fits = false
+		}
+		start = end
+	}
+	return lines, fits
+}
+
+// richPiece is the part of a word that belongs to a single TextRun
+type richPiece struct {
+	text string
+	run  int
+	size int32
+	// x is the pen position of the piece from the start of its line
+	x int32
+}
+
+// richWord is a word of rich text, which can span several runs, e.g. a word with one bold letter
+type richWord struct {
+	pieces      []richPiece
+	spaceBefore bool
+	// lineBreaks is the number of hard newlines before the word
+	lineBreaks int
+}
+
+// richLine is a line of rich text laid out by layoutRichText
+type richLine struct {
+	pieces []richPiece
+	// x is where the line starts and y is its baseline
+	x, y  int32
+	width int32
+	// size is the largest font size on the line
+	size int32
+}
+
+// WriteRichText draws runs inside of the bounding box as one flow of text, wrapped across lines the same way
+// WriteText wraps text, where every run can have its own font, color and size. Runs without white space
+// between them are joined into the same word. Each line is as tall as the largest run on it. The font size is
+// chosen so all of the lines fit the height of the bounding box.
+//
+// The text is drawn with the settings that apply to single glyphs, like letter spacing, but not the effects
+// that WriteText applies to the whole annotation, like the text background, supersampling or opacity. Left
+// and centered alignment are supported, justified text is left aligned
+func (c *Context) WriteRichText(runs []TextRun, boundingBox Rectangle) (image.Image, error) {
+	boundingBox, err := c.checkReady(boundingBox)
+	if err != nil {
+		return nil, err
+	}
+
+	// measuring and drawing a run uses a copy of the Context with the run's font
+	runContexts := make([]*Context, len(runs))
+	for i, run := range runs {
+		rc := *c
+		if run.Font != nil {
+			rc.font = run.Font
+		}
+		runContexts[i] = &rc
+	}
+	words := splitRichText(runs)
+
+	fontSize, fit := c.largestFit(func(fontSize int32) bool {
+		_, totalHeight := c.layoutRichText(runs, runContexts, words, boundingBox, fontSize)
+		return totalHeight <= boundingBox.Height
+	})
+	if !fit {
+		return nil, ErrTextOverflow
+	}
+	lines, _ := c.layoutRichText(runs, runContexts, words, boundingBox, fontSize)
+	c.fontSize = fontSize
+
+	var dst draw.Image
+	if srcImage, ok := c.src.(draw.Image); ok && c.inPlace && !c.needsBackground() {
+		dst = srcImage
+	} else {
+		dst = c.copySrc()
+	}
+	clip := dst.Bounds()
+	if !c.clipRect.Empty() {
+		clip = clip.Intersect(c.clipRect)
+	}
+
+	// glyphs sample their color relative to themselves, so only solid colors line up
+	defaultColor := c.fontColor
+	if _, ok := defaultColor.(*image.Uniform); !ok {
+		defaultColor = image.NewUniform(DefaultFontColor)
+	}
+	dpi := c.pinDPI(c.dpi)
+	imageContext := freetype.NewContext()
+	imageContext.SetDPI(dpi)
+	imageContext.SetDst(dst)
+	imageContext.SetClip(clip)
+	imageContext.SetHinting(freetype.FullHinting)
+	for _, line := range lines {
+		for _, piece := range line.pieces {
+			rc := runContexts[piece.run]
+			imageContext.SetFont(rc.font)
+			imageContext.SetFontSize(float64(piece.size))
+			if runColor := runs[piece.run].Color; runColor != nil {
+				imageContext.SetSrc(image.NewUniform(*runColor))
+			} else {
+				imageContext.SetSrc(defaultColor)
+			}
+			pt := raster.Point{X: raster.Fix32((line.x + piece.x) << 8), Y: raster.Fix32(line.y << 8)}
+			if _, err := rc.drawString(imageContext, piece.text, pt, piece.size, dpi, 1); err != nil {
+				return dst, err
+			}
+		}
+	}
+
+	c.src = dst
+	return dst, nil
+}
+
+// splitRichText splits runs into words at white space
+func splitRichText(runs []TextRun) []richWord {
+	words := []richWord{}
+	// whether the last rune was part of a word, which carries over from one run to the next
+	inWord := false
+	space, lineBreaks := false, 0
+	for i, run := range runs {
+		for _, r := range run.Text {
+			switch {
+			case r == '\n':
+				lineBreaks++
+				inWord = false
+			case isBreakingSpace(r):
+				space = true
+				inWord = false
+			default:
+				if !inWord {
+					words = append(words, richWord{spaceBefore: space, lineBreaks: lineBreaks})
+					space, lineBreaks = false, 0
+					inWord = true
+				}
+				word := &words[len(words)-1]
+				if n := len(word.pieces); n == 0 || word.pieces[n-1].run != i {
+					word.pieces = append(word.pieces, richPiece{run: i})
+				}
+				word.pieces[len(word.pieces)-1].text += string(r)
+			}
+		}
+	}
+	return words
+}
+
+// layoutRichText wraps and positions words of runs inside of boundingBox with fontSize as the size of a run
+// with a scale of 1, and returns the lines along with their total height
+func (c *Context) layoutRichText(runs []TextRun, runContexts []*Context, words []richWord, boundingBox Rectangle, fontSize int32) ([]*richLine, int32) {
+	sizes := make([]int32, len(runs))
+	for i, run := range runs {
+		sizes[i] = fontSize
+		if run.Scale > 0 {
+			sizes[i] = larger(1, int32(float64(fontSize)*run.Scale+0.5))
+		}
+	}
+
+	lines := []*richLine{{}}
+	for _, word := range words {
+		for k := 0; k < word.lineBreaks; k++ {
+			lines = append(lines, &richLine{})
+		}
+		line := lines[len(lines)-1]
+
+		pieces := make([]richPiece, len(word.pieces))
+		width := int32(0)
+		for j, piece := range word.pieces {
+			piece.size = sizes[piece.run]
+			piece.x = width
+			width += runContexts[piece.run].runesWidth([]rune(piece.text), piece.size)
+			pieces[j] = piece
+		}
+		space := int32(0)
+		if word.spaceBefore && len(line.pieces) > 0 {
+			first := pieces[0]
+			space = runContexts[first.run].runesWidth([]rune{' '}, first.size)
+		}
+		if len(line.pieces) > 0 && line.width+space+width > boundingBox.Width {
+			lines = append(lines, &richLine{})
+			line = lines[len(lines)-1]
+			space = 0
+		}
+
+		for _, piece := range pieces {
+			piece.x += line.width + space
+			line.pieces = append(line.pieces, piece)
+			line.size = larger(line.size, piece.size)
+		}
+		line.width += space + width
+	}
+
+	totalHeight := int32(0)
+	for i, line := range lines {
+		if line.size == 0 {
+			// blank lines are as tall as unscaled text
+			line.size = fontSize
+		}
+		line.x = boundingBox.X
+		if c.alignment == CENTERED {
+			line.x += (boundingBox.Width - line.width) / 2
+		}
+		if i == 0 {
+			line.y = boundingBox.Y + c.firstBaseline(line.size)
+		} else {
+			// the space below the line above plus the line advance of this line, without its own space below
+			line.y = lines[i-1].y + c.descentSpace(lines[i-1].size) + c.lineAdvance(line.size) - c.descentSpace(line.size)
+		}
+		totalHeight = line.y - boundingBox.Y
+	}
+	totalHeight += c.descentSpace(lines[len(lines)-1].size) + c.bottomPadding
+
+	return lines, totalHeight
+}
+
+// linesHeight positions lines inside of boundingBox and returns their total height
+func (c *Context) linesHeight(boundingBox Rectangle, lines []*Line, fontSize int32) int32 {
+	for _, line := range lines {
+		line.XPos, line.YPos, line.xFrac, line.yFrac, line.extraSpace = 0, 0, 0, 0, 0
+	}
+	_, totalHeight := c.calculateTextLineDimentions(boundingBox, lines, fontSize)
+	return totalHeight
+}
+
+// Layout lays out text inside of boundingBox the same way WriteText does, without drawing, and returns the
+// positioned lines along with the font size they were laid out at
+func (c *Context) Layout(text string, boundingBox Rectangle) ([]*Line, int32, error) {
+	if c.font == nil {
+		return nil, 0, ErrNoFont
+	}
+	if boundingBox.Width <= 0 || boundingBox.Height <= 0 {
+		return nil, 0, ErrInvalidBox
+	}
+	fit, lines, fontSize, _ := c.calculateSize(text, boundingBox, c.maxSize(), -1, 0)
+	if !fit {
+		return nil, 0, ErrTextOverflow
+	}
+	return lines, fontSize, nil
+}
+
+// GlyphBoxes lays out text inside of boundingBox the same way WriteText does, without drawing, and returns the
+// box of every rune that would be drawn, spaces included. Newlines are not included since they aren't drawn.
+//
+// Boxes are in source image pixel coordinates, the same space as Rectangle and Line positions
+func (c *Context) GlyphBoxes(text string, boundingBox Rectangle) ([]GlyphBox, error) {
+	if c.font == nil {
+		return nil, ErrNoFont
+	}
+	if boundingBox.Width <= 0 || boundingBox.Height <= 0 {
+		return nil, ErrInvalidBox
+	}
+	fit, lines, fontSize, _ := c.calculateSize(text, boundingBox, c.maxSize(), -1, 0)
+	if !fit {
+		return nil, ErrTextOverflow
+	}
+	return c.glyphBoxes(lines, fontSize), nil
+}
+
+// glyphBoxes returns the box of every rune of lines laid out at fontSize, see GlyphBoxes. The boxes follow the
+// pen the same way drawLines moves it, including the extra space after each word of a justified line
+func (c *Context) glyphBoxes(lines []*Line, fontSize int32) []GlyphBox {
+	bounds := c.bounds(fontSize)
+	scale := c.layoutScale(fontSize)
+
+	boxes := []GlyphBox{}
+	for i, line := range lines {
+		runes := []rune(line.joined())
+		x := line.XPos
+		for j, r := range runes {
+			if isMark(r) && j > 0 {
+				// combining marks are stacked over the character before them
+				boxes = append(boxes, GlyphBox{Rune: r, Line: i, Rect: boxes[len(boxes)-1].Rect})
+				continue
+			}
+			index := c.glyphIndex(r)
+			advance := c.glyphAdvance(index, scale)
+			if line.extraSpace > 0 && r == ' ' {
+				// justified words are drawn separately, so there's no kerning between a space and the next word
+				advance += line.extraSpace
+			} else {
+				for k := j + 1; k < len(runes); k++ {
+					if !isMark(runes[k]) {
+						advance += toPixels(c.kern(scale, index, c.glyphIndex(runes[k])))
+						break
+					}
+				}
+			}
+			boxes = append(boxes, GlyphBox{
+				Rune: r,
+				Line: i,
+				Rect: image.Rect(int(x), int(line.YPos-bounds.YMax), int(x+advance), int(line.YPos-bounds.YMin)),
+			})
+			x += advance
+		}
+	}
+	return boxes
+}
+
+// WriteTextWithSpans does the same thing as WriteText, and also reports where each of spans was drawn, e.g. to
+// build an image map of the links in the text. A span that wraps gets one rectangle per line it's drawn on.
+// White space that isn't drawn, like at the end of a wrapped line, isn't part of any rectangle. With
+// SetSmartTypography enabled, span offsets are into the text after its substitutions
+func (c *Context) WriteTextWithSpans(text string, boundingBox Rectangle, spans []Span) (image.Image, []ResolvedSpan, error) {
+	boundingBox, err := c.checkReady(boundingBox)
+	if err != nil {
+		return nil, nil, err
+	}
+	fit, lines, fontSize, _ := c.calculateSize(text, boundingBox, c.maxSize(), -1, 0)
+	if !fit {
+		return nil, nil, ErrTextOverflow
+	}
+	c.fontSize = fontSize
+
+	err, img := c.drawLines(lines, boundingBox, fontSize, c.dpi)
+	if err != nil {
+		return img, nil, err
+	}
+
+	// match the runes of text up with the glyphs that were drawn for them, -1 for runes that weren't drawn.
+	// Drawn runes are the runes of text with white space collapsed into single spaces
+	boxes := c.glyphBoxes(lines, fontSize)
+	if c.smartTypo {
+		text = smarten(text)
+	}
+	glyphIndex := []int{}
+	next := 0
+	for _, r := range text {
+		if next < len(boxes) && (boxes[next].Rune == r || (isBreakingSpace(r) && boxes[next].Rune == ' ')) {
+			glyphIndex = append(glyphIndex, next)
+			next++
+		} else {
+			glyphIndex = append(glyphIndex, -1)
+		}
+	}
+
+	resolved := make([]ResolvedSpan, len(spans))
+	for i, span := range spans {
+		resolved[i].Span = span
+		line := -1
+		for k := span.Start; k < span.End && k < len(glyphIndex); k++ {
+			if k < 0 || glyphIndex[k] == -1 {
+				continue
+			}
+			box := boxes[glyphIndex[k]]
+			if box.Line != line {
+				resolved[i].Rects = append(resolved[i].Rects, box.Rect)
+				line = box.Line
+			} else {
+				last := len(resolved[i].Rects) - 1
+				resolved[i].Rects[last] = resolved[i].Rects[last].Union(box.Rect)
+			}
+		}
+	}
+	return img, resolved, nil
+}
+
+// PreviewBounds lays out text inside of boundingBox the same way WriteText does and returns a quick sketch of
+// the layout instead of drawing glyphs: the outline of the bounding box in blue and a filled red rectangle
+// where each line sits. The preview is the size of the source image, or of the bounding box if no source is set.
+// Returns nil if no font is set
+func (c *Context) PreviewBounds(text string, boundingBox Rectangle) image.Image {
+	if c.font == nil {
+		return nil
+	}
+	box := boundingBox.Rect()
+	previewBounds := box
+	if c.src != nil {
+		previewBounds = c.src.Bounds()
+	}
+	preview := image.NewRGBA(previewBounds)
+
+	_, lines, fontSize, _ := c.calculateSize(text, boundingBox, c.maxSize(), -1, 0)
+	lineColor := image.NewUniform(Color{255 << 8, 0, 0, 255 << 8})
+	for _, line := range lines {
+		draw.Draw(preview, image.Rect(int(line.XPos),
+			int(line.YPos-int32(c.em(fontSize))),
+			int(line.XPos+line.currWidth),
+			int(line.YPos+int32(c.em(fontSize)*c.lineHeight))), lineColor, image.ZP, draw.Src)
+	}
+
+	outlineColor := image.NewUniform(Color{0, 0, 255 << 8, 255 << 8})
+	for _, edge := range []image.Rectangle{
+		image.Rect(box.Min.X, box.Min.Y, box.Max.X, box.Min.Y+1),
+		image.Rect(box.Min.X, box.Max.Y-1, box.Max.X, box.Max.Y),
+		image.Rect(box.Min.X, box.Min.Y, box.Min.X+1, box.Max.Y),
+		image.Rect(box.Max.X-1, box.Min.Y, box.Max.X, box.Max.Y),
+	} {
+		draw.Draw(preview, edge, outlineColor, image.ZP, draw.Src)
+	}
+	return preview
+}
+
+// RenderSVG lays text out the same way as WriteText but returns an SVG document instead of drawing glyphs, so
+// the result scales to any size. Each wrapped line is a <tspan> of a single <text> element, positioned at the
+// line's pen position and baseline in source image pixels. The document is the size of the source image, or of
+// the bounding box if no source is set. The font is referred to by its family name, so it has to be available
+// wherever the SVG is displayed. Fills other than a solid color, and effects like outlines, are left out
+func (c *Context) RenderSVG(text string, boundingBox Rectangle) ([]byte, error) {
+	if c.font == nil {
+		return nil, ErrNoFont
+	}
+	if boundingBox.Width <= 0 || boundingBox.Height <= 0 {
+		return nil, ErrInvalidBox
+	}
+	fit, lines, fontSize, _ := c.calculateSize(text, boundingBox, c.maxSize(), -1, 0)
+	if !fit {
+		return nil, ErrTextOverflow
+	}
+	c.fontSize = fontSize
+
+	bounds := boundingBox.Rect()
+	if c.src != nil {
+		bounds = c.src.Bounds()
+	}
+	fill, fillOpacity := "#000000", 1.0
+	if uniform, ok := c.fontColor.(*image.Uniform); ok {
+		col := color.NRGBA64Model.Convert(uniform.C).(color.NRGBA64)
+		fill = fmt.Sprintf("#%02x%02x%02x", col.R>>8, col.G>>8, col.B>>8)
+		fillOpacity = float64(col.A) / 0xffff
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="%d %d %d %d">`+"\n",
+		bounds.Dx(), bounds.Dy(), bounds.Min.X, bounds.Min.Y, bounds.Dx(), bounds.Dy())
+	fmt.Fprintf(&buf, `<text font-family="%s" font-size="%s" fill="%s" fill-opacity="%s">`+"\n",
+		escapeXML(c.font.Name(truetype.NameIDFontFamily)), svgNumber(c.em(fontSize)), fill,
+		svgNumber(fillOpacity))
+	for _, line := range lines {
+		if line.Blank() {
+			continue
+		}
+		spacing := ""
+		if line.extraSpace > 0 {
+			spacing = fmt.Sprintf(` word-spacing="%d"`, line.extraSpace)
+		}
+		fmt.Fprintf(&buf, `<tspan x="%s" y="%s"%s>%s</tspan>`+"\n",
+			svgNumber(float64(line.XPos)+line.xFrac), svgNumber(float64(line.YPos)+line.yFrac), spacing, escapeXML(line.joined()))
+	}
+	buf.WriteString("</text>\n</svg>\n")
+	return buf.Bytes(), nil
+}
+
+// svgNumber formats n with up to 3 decimal places and no trailing zeros
+func svgNumber(n float64) string {
+	return trimZeros(strconv.FormatFloat(n, 'f', 3, 64))
+}
+
+// escapeXML escapes s for use as XML character data or an attribute value
+func escapeXML(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// DrawLinesAt draws lines that have already been positioned by the caller, without any wrapping or fitting.
+// Use it to implement a custom layout on top of Annotate's rendering.
+//
+// XPos and YPos of each Line are in source image pixel coordinates. XPos is where the pen starts for the
+// first word and YPos is the baseline of the line, so descenders are drawn below YPos and the rest of the
+// glyphs above it.
+func (c *Context) DrawLinesAt(lines []Line, fontSize int32) (image.Image, error) {
+	// drawn from copies, so the caller's lines are left untouched and can be drawn again
+	linePtrs := make([]*Line, len(lines))
+	for i := range lines {
+		line := lines[i]
+		// the words may have been changed since the line was laid out
+		line.text, line.width = "", 0
+		linePtrs[i] = &line
+	}
+	err, img := c.drawLines(linePtrs, Rectangle{}, fontSize, c.dpi)
+	return img, err
+}
+
+// WrapText returns text broken into the lines that would be drawn inside of boundingBox at fontSize,
+// without drawing anything. Hard newlines in text always start a new line. Returns nil if no font is set
+func (c *Context) WrapText(text string, boundingBox Rectangle, fontSize int32) []string {
+	if c.font == nil {
+		return nil
+	}
+	lines := c.createTextLines(text, boundingBox, fontSize)
+	wrapped := make([]string, len(lines))
+	for i, line := range lines {
+		wrapped[i] = strings.Join(line.Words, " ")
+	}
+	return wrapped
+}
+
+// WrapPreview returns the lines WrapText would break text into, joined by newlines, for checking wrapping in
+// logs or tests without rendering anything. Returns "" if no font is set
+func (c *Context) WrapPreview(text string, boundingBox Rectangle, fontSize int32) string {
+	return strings.Join(c.WrapText(text, boundingBox, fontSize), "\n")
+}
+
+func (c *Context) createTextLines(text string, boundingBox Rectangle, fontSize int32) []*Line {
+	if c.smartTypo {
+		text = smarten(text)
+	}
+	hardLines := strings.Split(text, "\n")
+	lardLinesLen := len(hardLines)
+	spaceWidth := c.wordWidth(" ", false, fontSize)
+	trailingSpace := int32(0)
+	if c.trimTrailing {
+		trailingSpace = spaceWidth
+	}
+	lines := []*Line{}
+	bounds := c.bounds(fontSize)
+	padding := int32(float64(bounds.XMin+bounds.XMax) * c.lineHeight)
+	for i := 0; i < lardLinesLen; i++ {
+		hardLine := hardLines[i]
+		words := strings.FieldsFunc(hardLine, isBreakingSpace)
+		wordsLen := len(words)
+
+		firstLine := len(lines)
+		lines = append(lines, &Line{})
+		currLine := lines[len(lines)-1]
+		for j := 0; j < wordsLen; j++ {
+			word := words[j]
+			// runs of CJK text have no spaces to break at, so they are broken between characters instead
+			for c.cjkBreaking && !c.noWrap {
+				isFirstWord := len(currLine.Words) == 0
+				_, maxWidth := c.lineSpan(lines, len(lines)-1, boundingBox, fontSize)
+				available := maxWidth - currLine.currWidth - spaceWidth + trailingSpace - padding
+				if c.wordWidth(word, isFirstWord, fontSize) < available {
+					break
+				}
+				head := c.cjkPrefix(word, available, isFirstWord, fontSize)
+				if head == "" && isFirstWord {
+					// not even one character fits, let the word overflow
+					break
+				}
+				if head != "" {
+					currLine.Words = append(currLine.Words, head)
+					currLine.currWidth += spaceWidth + c.wordWidth(head, isFirstWord, fontSize) + padding
+					word = word[len(head):]
+				}
+				lines = append(lines, &Line{})
+				currLine = lines[len(lines)-1]
+			}
+
+			wordWidth := int32(0)
+			if len(currLine.Words) == 0 {
+				wordWidth = c.wordWidth(word, true, fontSize) + padding
+			} else {
+				wordWidth = c.wordWidth(word, false, fontSize) + padding
+			}
+			_, maxWidth := c.lineSpan(lines, len(lines)-1, boundingBox, fontSize)
+			if !c.noWrap && (wordWidth+currLine.currWidth+spaceWidth-trailingSpace) >= maxWidth &&
+				len(currLine.Words) != 0 && (c.breakFunc == nil || c.breakFunc(words[j-1], word)) {
+				lines = append(lines, &Line{})
+				currLine = lines[len(lines)-1]
+				wordWidth = c.wordWidth(word, true, fontSize) + padding
+			}
+			currLine.Words = append(currLine.Words, word)
+			currLine.currWidth += spaceWidth + wordWidth
+		}
+		if count := len(lines) - firstLine; c.lineBreaking == Balanced && !c.cjkBreaking && count > 1 {
+			balanced := c.balanceLines(words, count, lines[:firstLine], boundingBox, fontSize, spaceWidth, trailingSpace, padding)
+			if balanced != nil {
+				lines = append(lines[:firstLine], balanced...)
+			}
+		}
+		lines[len(lines)-1].ParagraphEnd = true
+	}
+	for _, line := range lines {
+		if line.Blank() {
+			continue
+		}
+		line.currWidth -= trailingSpace
+		line.text = strings.Join(line.Words, " ")
+		line.width = c.runesWidth([]rune(line.text), fontSize)
+	}
+	return lines
+}
+
+// balanceLines breaks words into count lines, which follow the lines above, so that the lines are as close to the
+// same width as possible. Widths are measured the same way createTextLines does. It returns nil if words can't
+// be broken into count lines that fit
+func (c *Context) balanceLines(words []string, count int, above []*Line, boundingBox Rectangle, fontSize, spaceWidth, trailingSpace, padding int32) []*Line {
+	n := len(words)
+	firstWidths := make([]int32, n)
+	widths := make([]int32, n)
+	for i, word := range words {
+		firstWidths[i] = spaceWidth + c.wordWidth(word, true, fontSize) + padding
+		widths[i] = spaceWidth + c.wordWidth(word, false, fontSize) + padding
+	}
+
+	// cost[k][j] is the least sum of the squared space left over on each line when the first j words are
+	// broken into k lines, and start[k][j] is the word the last of those lines starts with
+	const impossible = math.MaxInt64
+	cost := make([][]int64, count+1)
+	start := make([][]int, count+1)
+	for k := range cost {
+		cost[k] = make([]int64, n+1)
+		start[k] = make([]int, n+1)
+		for j := range cost[k] {
+			cost[k][j] = impossible
+		}
+	}
+	cost[0][0] = 0
+	for k := 1; k <= count; k++ {
+		_, maxWidth := c.lineSpan(above, len(above)+k-1, boundingBox, fontSize)
+		for j := k; j <= n; j++ {
+			rest := int32(0)
+			for i := j - 1; i >= k-1; i-- {
+				width := firstWidths[i] + rest - trailingSpace
+				rest += widths[i]
+				// a word too wide for a line of its own still gets one
+				if width >= maxWidth && i < j-1 {
+					break
+				}
+				if cost[k-1][i] == impossible || (i > 0 && c.breakFunc != nil && !c.breakFunc(words[i-1], words[i])) {
+					continue
+				}
+				slack := int64(maxWidth - width)
+				if total := cost[k-1][i] + slack*slack; total < cost[k][j] {
+					cost[k][j] = total
+					start[k][j] = i
+				}
+			}
+		}
+	}
+	if cost[count][n] == impossible {
+		return nil
+	}
+
+	lines := make([]*Line, count)
+	end := n
+	for k := count; k > 0; k-- {
+		i := start[k][end]
+		line := &Line{Words: append([]string(nil), words[i:end]...), currWidth: firstWidths[i]}
+		for _, width := range widths[i+1 : end] {
+			line.currWidth += width
+		}
+		lines[k-1] = line
+		end = i
+	}
+	return lines
+}
+
+// cjkPrefix returns the longest start of word that ends where CJK text may be broken and is narrower than
+// maxWidth, or "" if there is none
+func (c *Context) cjkPrefix(word string, maxWidth int32, isFirstWord bool, fontSize int32) string {
+	prefix := ""
+	prev := rune(-1)
+	for i, r := range word {
+		if prev != -1 && isCJKBreak(prev, r) {
+			if c.wordWidth(word[:i], isFirstWord, fontSize) >= maxWidth {
+				break
+			}
+			prefix = word[:i]
+		}
+		prev = r
+	}
+	return prefix
+}
+
+// isCJKBreak reports whether a line may be broken between prev and next. Either one has to be a CJK character,
+// so Latin words are never broken, and lines don't start with closing punctuation or end with opening punctuation
+func isCJKBreak(prev, next rune) bool {
+	if !isCJK(prev) && !isCJK(next) {
+		return false
 	}
-	return width
+	return !unicode.IsPunct(next) && !unicode.Is(unicode.Ps, prev)
 }
 
-func (c *Context) WriteText(text string, boundingBox Rectangle) (error, image.Image) {
-	fmt.Println("\n\n--------------------------------\n\n")
-	_, lines, fontSize := c.calculateSize(text, boundingBox, c.maxFontSize, -1, 0)
-	return c.drawLines(lines, boundingBox, fontSize)
+// isCJK reports whether r is a Chinese, Japanese or Korean character
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
 }
 
-func (c *Context) createTextLines(text string, boundingBox Rectangle, fontSize int32) []*Line {
-	hardLines := strings.Split(text, "\n")
-	lardLinesLen := len(hardLines)
-	spaceWidth := c.wordWidth(" ", false, fontSize)
-	lines := []*Line{}
-	bounds := c.font.Bounds(fontSize)
-	for i := 0; i < lardLinesLen; i++ {
-		hardLine := hardLines[i]
-		words := strings.Split(hardLine, " ")
-		wordsLen := len(words)
+// firstBaseline returns the distance from the top of the bounding box to the baseline of the first line
+func (c *Context) firstBaseline(fontSize int32) int32 {
+	switch c.topAlign {
+	case AscentTop:
+		return c.bounds(fontSize).YMax
+	case CapHeightTop:
+		// glyph bounds are loaded in 26.6 fixed point, at the scale the glyphs are drawn at
+		glyph := truetype.NewGlyphBuf()
+		err := glyph.Load(c.font, c.layoutScale(fontSize), c.font.Index('H'), truetype.NoHinting)
+		if err != nil || glyph.B.YMax <= 0 {
+			return c.bounds(fontSize).YMax
+		}
+		return (glyph.B.YMax + 63) >> 6
+	default:
+		return int32(c.em(fontSize))
+	}
+}
 
-		lines = append(lines, &Line{})
-		currLine := lines[len(lines)-1]
-		for j := 0; j < wordsLen; j++ {
-			word := words[j]
-			wordWidth := int32(0)
-			if j == 0 {
-				wordWidth = c.wordWidth(word, true, fontSize) + int32(float64(bounds.XMin+bounds.XMax)*c.lineHeight)
-			} else {
-				wordWidth = c.wordWidth(word, false, fontSize) + int32(float64(bounds.XMin+bounds.XMax)*c.lineHeight)
-			}
-			if (wordWidth+currLine.currWidth+spaceWidth) >= (int32(boundingBox.Width)) && j != 0 {
-				lines = append(lines, &Line{})
-				currLine = lines[len(lines)-1]
-				wordWidth = c.wordWidth(word, true, fontSize) + int32(float64(bounds.XMin+bounds.XMax)*c.lineHeight)
-			}
-			currLine.Words = append(currLine.Words, word)
-			currLine.currWidth += spaceWidth + wordWidth
+// lineWidth returns the width available to the line at index i, see SetLineWidthFunc
+func (c *Context) lineWidth(i int, boundingBox Rectangle) int32 {
+	if c.lineWidthFunc != nil {
+		return c.lineWidthFunc(i)
+	}
+	return boundingBox.Width
+}
+
+// lineSpan returns where the line at index i starts, relative to the left edge of the bounding box, and the
+// width available to it. A line beside the reserved region is moved past it or shortened to end before it,
+// whichever leaves more room, see SetReservedRegion. lines holds at least the lines above it
+func (c *Context) lineSpan(lines []*Line, i int, boundingBox Rectangle, fontSize int32) (int32, int32) {
+	width := c.lineWidth(i, boundingBox)
+	if c.reserved.Width <= 0 || c.reserved.Height <= 0 {
+		return 0, width
+	}
+	// the baseline is found the same way calculateTextLineDimentions positions lines
+	baseline := boundingBox.Y + c.firstBaseline(fontSize) + int32(i)*c.lineAdvance(fontSize)
+	for j := 0; j < i && j < len(lines); j++ {
+		if lines[j].ParagraphEnd && !lines[j].Blank() {
+			baseline += int32(c.paragraphSpace * c.em(fontSize))
 		}
 	}
-	return lines
+	bounds := c.bounds(fontSize)
+	line := Rectangle{X: boundingBox.X, Y: baseline - bounds.YMax, Width: width, Height: bounds.YMax - bounds.YMin}
+	if overlap := line.Intersect(c.reserved); overlap.Width <= 0 || overlap.Height <= 0 {
+		return 0, width
+	}
+	left := c.reserved.X - boundingBox.X
+	right := boundingBox.X + width - (c.reserved.X + c.reserved.Width)
+	if left >= right {
+		return 0, larger(left, 0)
+	}
+	return width - right, right
+}
+
+// isBreakingSpace reports whether text may be wrapped at r. All Unicode white space is a break point,
+// except for the non-breaking spaces
+func isBreakingSpace(r rune) bool {
+	switch r {
+	case '\u00a0', '\u2007', '\u202f':
+		return false
+	}
+	return unicode.IsSpace(r)
 }
 
 func (c *Context) calculateTextLineDimentions(boundingBox Rectangle, lines []*Line, fontSize int32) ([]*Line, int32) {
 	totalHeight := int32(0)
 	linesLen := len(lines)
-	bounds := c.font.Bounds(fontSize)
+	bounds := c.bounds(fontSize)
 	boundOneSide := int32(float64(bounds.XMin+bounds.XMax) * c.lineHeight / 2)
 	for i := 0; i < linesLen; i++ {
 		line := lines[i]
 
 		if i == 0 {
-			line.YPos += boundingBox.Y + fontSize
-			line.BaseToBaseHeight = fontSize
+			firstBaseline := c.firstBaseline(fontSize)
+			line.YPos += boundingBox.Y + firstBaseline
+			line.BaseToBaseHeight = firstBaseline
 		} else {
-			overHeadSpace := int32(c.lineHeight*float64(fontSize)) + fontSize
+			overHeadSpace := c.lineAdvance(fontSize)
+			exactSpace := float64(overHeadSpace)
+			if !c.useLeading {
+				exactSpace = c.lineHeight*c.em(fontSize) + c.em(fontSize)
+			}
+			// a blank line already separates paragraphs, it doesn't start one of its own
+			if lines[i-1].ParagraphEnd && !lines[i-1].Blank() {
+				overHeadSpace += int32(c.paragraphSpace * c.em(fontSize))
+				exactSpace += c.paragraphSpace * c.em(fontSize)
+			}
 			line.YPos += lines[i-1].YPos + overHeadSpace
 			line.BaseToBaseHeight = overHeadSpace
+			if c.subPixel && !c.deterministic && !c.baselineSnap {
+				// carry the fraction of a pixel the space was truncated by over to the lines below
+				line.yFrac = lines[i-1].yFrac + exactSpace - float64(overHeadSpace)
+				for line.yFrac >= 1 {
+					line.YPos++
+					line.yFrac--
+				}
+			}
 		}
-		line.XPos += boundingBox.X
+		offset, width := c.lineSpan(lines, i, boundingBox, fontSize)
+		line.XPos += boundingBox.X + offset
 		if c.alignment == CENTERED {
 			lineCenter := line.XPos + line.currWidth/2
-			boxCenter := boundingBox.X + boundingBox.Width/2
+			boxCenter := boundingBox.X + offset + width/2
 			centerDelta := boxCenter - lineCenter
 			line.XPos += centerDelta + boundOneSide
+			if c.subPixel && !c.deterministic {
+				// the integer math above truncates both halves, keep what was lost
+				line.xFrac = float64(width%2)/2 - float64(line.currWidth%2)/2
+			}
+		}
+		if c.alignment == JUSTIFIED && !line.ParagraphEnd && len(line.Words) > 1 {
+			line.extraSpace = larger(0, (width-line.currWidth)/int32(len(line.Words)-1))
 		}
 		totalHeight += line.BaseToBaseHeight
 	}
 	//we add a little buffer zone to the bottom of the text to make sure some runes like "g" don't get cut off
-	totalHeight += int32(c.lineHeight * float64(fontSize))
+	totalHeight += c.descentSpace(fontSize)
+	totalHeight += c.bottomPadding
 
 	return lines, totalHeight
 }
 
-func (c *Context) calculateSize(text string, boundingBox Rectangle, fontSize int32, attempt int32, lastFit int32) (bool, []*Line, int32) {
+// calculateSize searches for the largest font size up to fontSize at which text fits inside of boundingBox.
+// It returns whether any size fit, the lines laid out at the chosen size, the size, and the number of sizes
+// that were tried. If no size fits, the lines are laid out at size 1.
+// With the aspect lock enabled, sizes at which the wrapped text keeps the shape of the box are preferred, but
+// if there are none the size is chosen as if the lock were disabled
+func (c *Context) calculateSize(text string, boundingBox Rectangle, fontSize int32, attempt int32, lastFit int32) (bool, []*Line, int32, int32) {
+	fit, lines, size, iterations := c.searchSize(text, boundingBox, fontSize, attempt, lastFit, fontSize+1, c.aspectLock)
+	if !c.aspectLock || fit {
+		return fit, lines, size, iterations
+	}
+	fit, lines, size, more := c.searchSize(text, boundingBox, fontSize, attempt, lastFit, fontSize+1, false)
+	return fit, lines, size, iterations + more
+}
+
+// searchSize does the binary search for calculateSize. lastFit is the largest size known to fit, 0 for none,
+// and lastMiss the smallest size known not to fit. Only sizes at which the text keeps the shape of the box
+// are accepted when shaped is true
+func (c *Context) searchSize(text string, boundingBox Rectangle, fontSize int32, attempt int32, lastFit int32, lastMiss int32, shaped bool) (bool, []*Line, int32, int32) {
 	lines := c.createTextLines(text, boundingBox, fontSize)
 	lines, totalHeight := c.calculateTextLineDimentions(boundingBox, lines, fontSize)
 
 	attempt++
 	// if we are trying with the user specified max font size and it fits, return
-	if attempt == 0 && totalHeight <= boundingBox.Height {
-		return true, lines, fontSize
-	}
-	if totalHeight <= boundingBox.Height {
-		if fontSize == lastFit {
-			return true, lines, fontSize
-		} else if math.Abs(float64(fontSize-lastFit)) == 1 {
-			return true, lines, larger(lastFit, fontSize)
-		} else {
-			newFontSize := int32(math.Floor(float64(fontSize+c.maxFontSize)/2 + 0.5))
-			return c.calculateSize(text, boundingBox, newFontSize, attempt, fontSize)
-		}
+	fits := c.fits(lines, totalHeight, boundingBox, fontSize) && (!shaped || c.keepsShape(lines, totalHeight, boundingBox))
+	if attempt == 0 && fits {
+		return true, lines, fontSize, attempt + 1
+	}
+	if fits {
+		lastFit = fontSize
 	} else {
-		if math.Abs(float64(fontSize-lastFit)) == 1 {
-			return true, lines, larger(lastFit, fontSize)
-		} else {
-			newFontSize := int32(math.Floor(float64(fontSize+lastFit)/2 + 0.5))
-			return c.calculateSize(text, boundingBox, newFontSize, attempt, lastFit)
+		lastMiss = fontSize
+	}
+
+	// stop once the largest size that fits is known to within the tolerance, or nothing fits even at size 1
+	if lastFit == 0 && lastMiss <= 1 {
+		return false, lines, fontSize, attempt + 1
+	}
+	if lastFit > 0 && lastMiss-lastFit <= larger(c.tolerance, 1) {
+		if !fits {
+			// the lines were laid out at a size that doesn't fit, lay them out again at the one that does
+			lines, _ = c.calculateTextLineDimentions(boundingBox, c.createTextLines(text, boundingBox, lastFit), lastFit)
 		}
+		return true, lines, lastFit, attempt + 1
+	}
+	newFontSize := int32(math.Floor(float64(lastFit+lastMiss)/2 + 0.5))
+	return c.searchSize(text, boundingBox, newFontSize, attempt, lastFit, lastMiss, shaped)
+}
+
+// fits reports whether lines laid out at fontSize with a total height of totalHeight fit inside of boundingBox
+// according to the fit strategy
+func (c *Context) fits(lines []*Line, totalHeight int32, boundingBox Rectangle, fontSize int32) bool {
+	// how far the widest line sticks out past the span it was wrapped to, if at all, so a line beside the
+	// reserved region has to fit the space left next to it
+	overflow := int32(math.MinInt32)
+	for i, line := range lines {
+		_, width := c.lineSpan(lines, i, boundingBox, fontSize)
+		overflow = larger(overflow, line.currWidth-width)
+	}
+	// lines that aren't wrapped always have to fit across
+	if c.noWrap && overflow > 0 {
+		return false
+	}
+	switch c.fitStrategy {
+	case FitWidth:
+		return overflow <= 0
+	case FitWidthAndHeight:
+		return overflow <= 0 && totalHeight <= boundingBox.Height
+	default:
+		return totalHeight <= boundingBox.Height
+	}
+}
 
+// keepsShape reports whether the wrapped paragraphs in lines are no taller, relative to the width of their widest
+// line, than boundingBox is relative to its width, see SetAspectLock. Lines that end at a hard newline and
+// paragraphs that fit on one line are left out, since wrapping at a smaller size can't make them any wider.
+// Lines are taken to share totalHeight evenly
+func (c *Context) keepsShape(lines []*Line, totalHeight int32, boundingBox Rectangle) bool {
+	wrapped, widest := int64(0), int32(0)
+	start := 0
+	for i, line := range lines {
+		if !line.ParagraphEnd && i < len(lines)-1 {
+			continue
+		}
+		if i > start {
+			wrapped += int64(i - start + 1)
+			for _, wrappedLine := range lines[start : i+1] {
+				widest = larger(widest, wrappedLine.currWidth)
+			}
+		}
+		start = i + 1
 	}
+	if wrapped == 0 {
+		return true
+	}
+	// compared as wrappedHeight/widest <= height/width, without dividing
+	return int64(totalHeight)*wrapped*int64(boundingBox.Width) <=
+		int64(widest)*int64(boundingBox.Height)*int64(len(lines))
 }
 
 func larger(a, b int32) int32 {
@@ -332,42 +3089,703 @@ func larger(a, b int32) int32 {
 	}
 }
 
-func (c *Context) drawLines(lines []*Line, boundingBox Rectangle, fontSize int32) (error, image.Image) {
+// tiledImage repeats an image infinitely in every direction
+type tiledImage struct {
+	image.Image
+}
+
+func (t tiledImage) Bounds() image.Rectangle {
+	return image.Rect(-1e9, -1e9, 1e9, 1e9)
+}
+
+func (t tiledImage) At(x, y int) color.Color {
+	b := t.Image.Bounds()
+	if b.Empty() {
+		return color.Transparent
+	}
+	x = b.Min.X + ((x-b.Min.X)%b.Dx()+b.Dx())%b.Dx()
+	y = b.Min.Y + ((y-b.Min.Y)%b.Dy()+b.Dy())%b.Dy()
+	return t.Image.At(x, y)
+}
+
+// linearGradient is an image that fades between two colors across rect
+type linearGradient struct {
+	from, to Color
+	dir      GradientDirection
+	rect     image.Rectangle
+}
+
+// over returns the gradient stretched across r
+func (g *linearGradient) over(r image.Rectangle) *linearGradient {
+	stretched := *g
+	stretched.rect = r
+	return &stretched
+}
+
+func (g *linearGradient) ColorModel() color.Model {
+	return color.RGBA64Model
+}
+
+func (g *linearGradient) Bounds() image.Rectangle {
+	return g.rect
+}
+
+func (g *linearGradient) At(x, y int) color.Color {
+	pos, length := y-g.rect.Min.Y, g.rect.Dy()
+	if g.dir == GradientHorizontal {
+		pos, length = x-g.rect.Min.X, g.rect.Dx()
+	}
+	// the first and last rows or columns are exactly the end colors
+	t := 0.0
+	if length > 1 {
+		t = math.Max(0, math.Min(1, float64(pos)/float64(length-1)))
+	}
+	mix := func(a, b uint32) uint32 {
+		return uint32(float64(a) + (float64(b)-float64(a))*t + 0.5)
+	}
+	return Color{mix(g.from.R, g.to.R), mix(g.from.G, g.to.G), mix(g.from.B, g.to.B), mix(g.from.A, g.to.A)}
+}
+
+// checkReady returns an error if text can't be drawn inside of boundingBox with the current settings.
+// Otherwise it returns the bounding box to draw in, which is clamped to the source if SetClampBox is enabled
+func (c *Context) checkReady(boundingBox Rectangle) (Rectangle, error) {
+	if c.font == nil {
+		return boundingBox, ErrNoFont
+	}
+	if c.src == nil {
+		return boundingBox, ErrNoSource
+	}
+	if err := c.checkPixels(c.src.Bounds()); err != nil {
+		return boundingBox, err
+	}
+	if boundingBox.Width <= 0 || boundingBox.Height <= 0 {
+		return boundingBox, ErrInvalidBox
+	}
+
+	box := boundingBox.Rect()
+	if !box.Overlaps(c.src.Bounds()) {
+		return boundingBox, ErrInvalidBox
+	}
+	if c.clampBox {
+		boundingBox = RectangleOf(box.Intersect(c.src.Bounds()))
+	}
+	return boundingBox, nil
+}
+
+// copySrc returns a copy of the source image, see newImageLike
+func (c *Context) copySrc() draw.Image {
+	img := newImageLike(c.src, c.src.Bounds())
+	c.drawSrc(img)
+	return img
+}
+
+// needsBackground reports whether the source may have transparent pixels to fill with the background color
+func (c *Context) needsBackground() bool {
+	if c.bgColor == nil {
+		return false
+	}
+	opaque, ok := c.src.(interface {
+		Opaque() bool
+	})
+	return !ok || !opaque.Opaque()
+}
+
+// drawSrc draws the source image onto dst, over the background color if it needs one
+func (c *Context) drawSrc(dst draw.Image) {
+	bounds := c.src.Bounds()
+	if !c.needsBackground() {
+		draw.Draw(dst, bounds, c.src, bounds.Min, draw.Src)
+		return
+	}
+	draw.Draw(dst, bounds, image.NewUniform(*c.bgColor), image.ZP, draw.Src)
+	draw.Draw(dst, bounds, c.src, bounds.Min, draw.Over)
+}
+
+// scratchPools holds the pixel buffers of the temporary images drawLines draws into, so annotating many images
+// doesn't allocate new ones every time. Buffers are pooled by size class: pool i holds buffers of 1<<i bytes, and
+// an image takes a buffer from the smallest class that fits it. The number of pools is fixed no matter how many
+// different sizes of image are annotated
+var scratchPools [48]sync.Pool
+
+// scratchClass returns the size class of a buffer of n bytes, see scratchPools
+func scratchClass(n int) int {
+	class := 0
+	for 1<<uint(class) < n {
+		class++
+	}
+	return class
+}
+
+// scratchPix returns a buffer of n bytes from the pool, or a new one if the pool is empty. Its bytes are left as
+// they were
+func scratchPix(n int) []uint8 {
+	class := scratchClass(n)
+	if class >= len(scratchPools) {
+		return make([]uint8, n)
+	}
+	if pix, ok := scratchPools[class].Get().([]uint8); ok {
+		return pix[:n]
+	}
+	return make([]uint8, n, 1<<uint(class))
+}
+
+// scratchAlpha returns a blank mask with bounds r, using a buffer from the pool when there is one
+func scratchAlpha(r image.Rectangle) *image.Alpha {
+	pix := scratchPix(r.Dx() * r.Dy())
+	for i := range pix {
+		pix[i] = 0
+	}
+	return &image.Alpha{Pix: pix, Stride: r.Dx(), Rect: r}
+}
+
+// scratchImageLike does the same thing as newImageLike, except RGBA images use a buffer from the pool. Their
+// pixels are left as they were, so they have to be overwritten
+func scratchImageLike(src image.Image, r image.Rectangle) draw.Image {
+	img := newImageLike(src, image.Rectangle{})
+	if _, ok := img.(*image.RGBA); !ok {
+		return newImageLike(src, r)
+	}
+	return &image.RGBA{Pix: scratchPix(4 * r.Dx() * r.Dy()), Stride: 4 * r.Dx(), Rect: r}
+}
+
+// putScratch returns the buffer of a temporary image to its pool once the image is no longer used
+func putScratch(img image.Image) {
+	var pix []uint8
+	switch scratch := img.(type) {
+	case *image.Alpha:
+		pix = scratch.Pix
+	case *image.RGBA:
+		pix = scratch.Pix
+	default:
+		return
+	}
+	// Only buffers made by scratchPix have a capacity that is a power of two no larger than the biggest class
+	class := scratchClass(cap(pix))
+	if cap(pix) == 0 || 1<<uint(class) != cap(pix) || class >= len(scratchPools) {
+		return
+	}
+	scratchPools[class].Put(pix[:0])
+}
+
+// newImageLike returns a blank image with bounds r that can hold the colors of src without losing precision.
+// Sources with 16 bits per channel get an RGBA64 image, everything else gets an RGBA image
+func newImageLike(src image.Image, r image.Rectangle) draw.Image {
+	switch src.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		return image.NewRGBA64(r)
+	default:
+		return image.NewRGBA(r)
+	}
+}
+
+func (c *Context) drawLines(lines []*Line, boundingBox Rectangle, fontSize int32, dpi float64) (error, image.Image) {
+	if c.font == nil {
+		return ErrNoFont, nil
+	}
+	if c.src == nil {
+		return ErrNoSource, nil
+	}
+	if err := c.checkPixels(c.src.Bounds()); err != nil {
+		return err, nil
+	}
+	dpi = c.pinDPI(dpi)
 	imageContext := freetype.NewContext()
 	imageContext.SetFont(c.font)
-	imageContext.SetDPI(c.dpi)
+	imageContext.SetDPI(dpi)
+	renderDPI := dpi
 
-	rgba := image.NewRGBA(c.src.Bounds())
-	draw.Draw(rgba, rgba.Bounds(), c.src, image.ZP, 0)
+	dstBounds := c.src.Bounds()
+	if c.autoExpand {
+		dstBounds = dstBounds.Union(c.annotationBounds(lines, boundingBox, fontSize))
+	}
+	var dst draw.Image
+	if srcImage, ok := c.src.(draw.Image); ok && c.inPlace && dstBounds == c.src.Bounds() && !c.needsBackground() {
+		dst = srcImage
+	} else {
+		dst = newImageLike(c.src, dstBounds)
+		if dstBounds != c.src.Bounds() {
+			draw.Draw(dst, dstBounds, image.NewUniform(c.expandColor), image.ZP, draw.Src)
+		}
+		c.drawSrc(dst)
+	}
+
+	clip := dst.Bounds()
+	if !c.clipRect.Empty() {
+		clip = clip.Intersect(c.clipRect)
+	}
+
+	// a translucent annotation is drawn onto its own layer, which is blended onto the destination at the end.
+	// The layer starts out transparent rather than as a copy of the destination, otherwise blending the copy
+	// back would change translucent pixels of the source that weren't annotated
+	target := dst
+	if c.opacity < 1 {
+		layer := scratchImageLike(target, target.Bounds())
+		defer putScratch(layer)
+		draw.Draw(layer, layer.Bounds(), image.Transparent, image.ZP, draw.Src)
+		dst = layer
+	}
 
-	imageContext.SetSrc(c.fontColor)
-	imageContext.SetDst(rgba)
+	// the region the text is laid out in, the whole image when drawing lines without a bounding box
+	region := boundingBox.Rect()
+	if region.Empty() {
+		region = dst.Bounds()
+	}
+
+	fontColor := c.fontColor
+	if c.contrastColors != nil {
+		fontColor = image.NewUniform(c.contrastColor(region))
+	}
+	if fontColor == nil {
+		fontColor = image.NewUniform(DefaultFontColor)
+	}
+	scale := 1
+	if c.supersample > 1 {
+		scale = c.supersample
+	}
+	// glyph coverage is rendered into a separate mask when it has to be adjusted before compositing
+	var glyphMask *image.Alpha
+	_, isUniform := fontColor.(*image.Uniform)
+	// freetype samples the src relative to each glyph rather than the destination, so image fills are
+	// composited through the mask to keep them aligned to the source
+	// mirrored glyphs are flipped in the mask, within the region
+	flipped := c.flipH || c.flipV
+	// freetype draws a glyph that is cut off by the left edge of its clip from the wrong part of the glyph,
+	// so text that crosses the left edge, e.g. of a box starting left of the image, is rendered into a mask
+	// that reaches past the edge
+	annotated := c.annotationBounds(lines, boundingBox, fontSize)
+	leftCut := annotated.Min.X < clip.Min.X
+	// where glyphs are drawn, the part of the clip the text lands on when it's rendered into a mask
+	textClip := clip
+	// what freetype draws into, at the render scale
+	maskArea := clip
+	if c.adjustsCoverage() || !isUniform || scale > 1 || flipped || leftCut {
+		// glyphs may overhang their advances, and flipping mirrors them within the region
+		textArea := annotated.Inset(-int(c.em(fontSize)) - 1)
+		if flipped {
+			textArea = textArea.Union(c.mirror(textArea, region))
+		}
+		textClip = textArea.Intersect(clip)
+		b := textClip
+		if leftCut {
+			b.Min.X = textArea.Min.X
+		}
+		b = image.Rect(b.Min.X*scale, b.Min.Y*scale, b.Max.X*scale, b.Max.Y*scale)
+		maskArea = b
+		if err := c.checkPixels(b); err != nil {
+			return err, nil
+		}
+		glyphMask = scratchAlpha(b)
+		defer putScratch(glyphMask)
+		renderDPI = dpi * float64(scale)
+		imageContext.SetDPI(renderDPI)
+		imageContext.SetSrc(image.Opaque)
+		imageContext.SetDst(glyphMask)
+	} else {
+		imageContext.SetSrc(fontColor)
+		imageContext.SetDst(dst)
+	}
 	imageContext.SetHinting(freetype.FullHinting)
 	imageContext.SetFontSize(float64(fontSize))
 
+	if c.backdropBlur > 0 {
+		// blurred from target, which holds the source already drawn over the background color
+		backdrop := boundingBox.Rect()
+		blurRegion(dst, target, backdrop.Intersect(clip), c.backdropBlur)
+	}
 	if c.debugEnabled {
 		debugImage := image.NewUniform(Color{0, 0, 255 << 8, 255 << 8})
-		draw.Draw(rgba, image.Rect(int(boundingBox.X),
-			int(boundingBox.Y),
-			int(boundingBox.X+boundingBox.Width),
-			int(boundingBox.Y+boundingBox.Height)), debugImage, image.ZP, 0)
+		draw.Draw(dst, boundingBox.Rect(), debugImage, image.ZP, 0)
 	}
-	imageContext.SetClip(c.src.Bounds())
-	for _, line := range lines {
-		words := strings.Join(line.Words, " ")
+	if c.textBackground != nil {
+		panel := boundingBox.Rect()
+		visible := panel.Intersect(clip)
+		background := c.textBackground
+		if gradient, ok := background.(*linearGradient); ok {
+			background = gradient.over(panel)
+		}
+		draw.DrawMask(dst, visible, background, visible.Min,
+			roundedRectMask(panel, c.textBgRadius), visible.Min, draw.Over)
+	}
+	imageContext.SetClip(maskArea)
+	var drawnInto image.Image = dst
+	if glyphMask != nil {
+		drawnInto = glyphMask
+	}
+	for i, line := range lines {
+		if line.Blank() {
+			line.end = image.Pt(int(line.XPos), int(line.YPos))
+			if c.lineCallback != nil {
+				c.lineCallback(i, drawnInto)
+			}
+			continue
+		}
+		words := line.joined()
 		if c.debugEnabled {
 			debugImage2 := image.NewUniform(Color{255 << 8, 0, 0, 255 << 8})
-			draw.Draw(rgba, image.Rect(int(line.XPos),
-				int(line.YPos+int32(float64(fontSize)*c.lineHeight)),
+			draw.Draw(dst, image.Rect(int(line.XPos),
+				int(line.YPos+int32(c.em(fontSize)*c.lineHeight)),
 				int(line.XPos+line.currWidth),
-				int(line.YPos-fontSize)), debugImage2, image.ZP, 0)
+				int(line.YPos-int32(c.em(fontSize)))), debugImage2, image.ZP, 0)
+		}
+		if line.highlighted != nil {
+			c.drawWordHighlights(dst, clip, region, line, fontSize)
+		}
+		var err error
+		if line.extraSpace > 0 {
+			_, err = c.drawJustified(imageContext, line, fontSize, renderDPI, scale)
+		} else {
+			_, err = c.drawString(imageContext, words, line.origin(scale), fontSize, renderDPI, scale)
+		}
+		if err != nil {
+			return err, target
+		}
+		// measured the same way as the layout, so the end is always XPos plus the width the line was given
+		line.end = image.Pt(int(line.XPos+c.drawnWidth(line, fontSize)), int(line.YPos))
+		if c.lineCallback != nil {
+			c.lineCallback(i, drawnInto)
+		}
+	}
+
+	if glyphMask != nil {
+		if scale > 1 {
+			glyphMask = c.downsample(glyphMask, scale)
+		}
+		c.adjustCoverage(glyphMask)
+		if flipped {
+			glyphMask = flipAlpha(glyphMask, region, c.flipH, c.flipV)
+		}
+		fillPoint := textClip.Min.Sub(c.fontImageShift)
+		draw.DrawMask(dst, textClip, fontColor, fillPoint, glyphMask, textClip.Min, draw.Over)
+	}
+	if dst != target {
+		opacity := image.NewUniform(color.Alpha16{uint16(c.opacity * 0xffff)})
+		draw.DrawMask(target, clip, dst, clip.Min, opacity, image.ZP, draw.Over)
+	}
+
+	c.src = target
+	return nil, target
+}
+
+// drawnWidth returns how far drawing line at fontSize moves the pen from XPos. That's the width of the line,
+// plus the extra space between the words of a justified line, which are drawn one at a time, see drawJustified
+func (c *Context) drawnWidth(line *Line, fontSize int32) int32 {
+	if line.extraSpace == 0 {
+		if line.width != 0 {
+			return line.width
+		}
+		return c.runesWidth([]rune(line.joined()), fontSize)
+	}
+	width := int32(0)
+	for i, word := range line.Words {
+		if i == len(line.Words)-1 {
+			width += c.runesWidth([]rune(word), fontSize)
+		} else {
+			width += c.runesWidth([]rune(word+" "), fontSize) + line.extraSpace
+		}
+	}
+	return width
+}
+
+// annotationBounds returns the area that drawing lines at fontSize covers: the glyphs, and the bounding box
+// when something is drawn behind the text
+func (c *Context) annotationBounds(lines []*Line, boundingBox Rectangle, fontSize int32) image.Rectangle {
+	var r image.Rectangle
+	if c.textBackground != nil || c.backdropBlur > 0 {
+		r = boundingBox.Rect()
+	}
+	bounds := c.bounds(fontSize)
+	for _, line := range lines {
+		if line.Blank() {
+			continue
+		}
+		width := c.drawnWidth(line, fontSize)
+		r = r.Union(image.Rect(int(line.XPos+bounds.XMin),
+			int(line.YPos-bounds.YMax),
+			int(line.XPos+width),
+			int(line.YPos-bounds.YMin)))
+	}
+	return r
+}
+
+// drawString draws s with its pen starting at pt and returns where the pen ends up. dpi is the resolution
+// imageContext renders at and scale is the supersampling factor
+func (c *Context) drawString(imageContext *freetype.Context, s string, pt raster.Point, fontSize int32, dpi float64, scale int) (raster.Point, error) {
+	// freetype always kerns and looks runes up as they are, so text that shouldn't be kerned or has remapped
+	// runes is drawn a glyph at a time
+	if c.letterSpacing == 0 && !c.glyphByGlyph && c.kerning != KernOff && c.runeMap == nil &&
+		strings.IndexFunc(s, isMark) == -1 {
+		return imageContext.DrawString(s, pt)
+	}
+	return c.drawGlyphs(imageContext, s, pt, fontSize, dpi, scale)
+}
+
+// drawGlyphs does the same thing as drawString, but draws one glyph at a time so each glyph's position can be
+// adjusted. It mirrors freetype's DrawString: the metrics are computed at the same 26.6 scale freetype uses,
+// shifted to 24.8, and kerning is rounded to whole pixels since glyphs are hinted
+func (c *Context) drawGlyphs(imageContext *freetype.Context, s string, pt raster.Point, fontSize int32, dpi float64, scale int) (raster.Point, error) {
+	renderScale := int32(float64(fontSize) * dpi * 64 / 72)
+	spacing := raster.Fix32(scale) * raster.Fix32(c.letterSpacing<<8)
+	prev, hasPrev := truetype.Index(0), false
+	// where the last base character was drawn and its advance, for positioning combining marks over it
+	var baseX, baseAdvance raster.Fix32
+	for _, r := range s {
+		r = c.mapRune(r)
+		index := c.font.Index(r)
+		if isMark(r) && hasPrev {
+			// marks without an advance are designed to be drawn at the pen position after their base.
+			// Others are centered over the base, and neither moves the pen
+			markAdvance := raster.Fix32(c.font.HMetric(renderScale, index).AdvanceWidth) << 2
+			markPt := raster.Point{X: baseX + baseAdvance, Y: pt.Y}
+			if markAdvance != 0 {
+				markPt.X = baseX + (baseAdvance-markAdvance)/2
+			}
+			if _, err := imageContext.DrawString(string(r), markPt); err != nil {
+				return pt, err
+			}
+			continue
+		}
+		if hasPrev {
+			kern := raster.Fix32(c.kern(renderScale, prev, index)) << 2
+			pt.X += (kern + 128) &^ 255
+		}
+		end, err := imageContext.DrawString(string(r), pt)
+		if err != nil {
+			return pt, err
 		}
-		_, err := imageContext.DrawString(words, raster.Point{X: raster.Fix32(line.XPos << 8), Y: raster.Fix32((line.YPos) << 8)})
+		advance := end.X - pt.X
+		baseX, baseAdvance = pt.X, advance
+		spaced := advance + spacing
+		if floor := advance / 10; spaced < floor {
+			spaced = floor
+		}
+		pt.X += spaced
+		prev, hasPrev = index, true
+	}
+	return pt, nil
+}
+
+// drawJustified draws line one word at a time, adding the line's extra space after each word. It returns where
+// the pen ended up after the last word
+func (c *Context) drawJustified(imageContext *freetype.Context, line *Line, fontSize int32, dpi float64, scale int) (raster.Point, error) {
+	pt := line.origin(scale)
+	for i, word := range line.Words {
+		if i == len(line.Words)-1 {
+			return c.drawString(imageContext, word, pt, fontSize, dpi, scale)
+		}
+		end, err := c.drawString(imageContext, word+" ", pt, fontSize, dpi, scale)
 		if err != nil {
-			return err, rgba
+			return end, err
+		}
+		pt = raster.Point{X: end.X + raster.Fix32(scale)*raster.Fix32(line.extraSpace<<8), Y: end.Y}
+	}
+	return pt, nil
+}
+
+// drawWordHighlights fills the area behind each highlighted word of line, within clip
+func (c *Context) drawWordHighlights(dst draw.Image, clip, flipRegion image.Rectangle, line *Line, fontSize int32) {
+	highlight := c.wordHighlight
+	if highlight == nil {
+		highlight = image.NewUniform(DefaultHighlightColor)
+	}
+	bounds := c.bounds(fontSize)
+
+	x := line.XPos
+	for j, word := range line.Words {
+		wordWidth := c.runesWidth([]rune(word), fontSize)
+		if line.extraSpace == 0 {
+			// the line is drawn as one string, so the word starts where the text up to its end, less the word,
+			// takes the pen, which counts the kerning around the spaces before it
+			x = line.XPos + c.runesWidth([]rune(strings.Join(line.Words[:j+1], " ")), fontSize) - wordWidth
+		}
+		if line.highlighted[j] {
+			r := c.mirror(image.Rect(int(x),
+				int(line.YPos-bounds.YMax),
+				int(x+wordWidth),
+				int(line.YPos-bounds.YMin)), flipRegion)
+			draw.Draw(dst, r.Intersect(clip), highlight, image.ZP, draw.Over)
+		}
+		if line.extraSpace > 0 {
+			// justified words are drawn one at a time, each followed by a space and the extra space, see drawJustified
+			x += c.runesWidth([]rune(word+" "), fontSize) + line.extraSpace
+		}
+	}
+}
+
+// adjustsCoverage reports whether adjustCoverage changes glyph masks with the current settings
+func (c *Context) adjustsCoverage() bool {
+	return !c.antialias || (c.gamma > 0 && c.gamma != 1)
+}
+
+// adjustCoverage applies the coverage related settings to a rendered glyph mask
+func (c *Context) adjustCoverage(mask *image.Alpha) {
+	if c.gamma > 0 && c.gamma != 1 {
+		var table [256]uint8
+		for i := range table {
+			table[i] = uint8(math.Pow(float64(i)/255, 1/c.gamma)*255 + 0.5)
+		}
+		for i, a := range mask.Pix {
+			mask.Pix[i] = table[a]
+		}
+	}
+	if !c.antialias {
+		for i, a := range mask.Pix {
+			if a >= 0x80 {
+				mask.Pix[i] = 0xff
+			} else {
+				mask.Pix[i] = 0
+			}
+		}
+	}
+}
+
+// mirror returns r mirrored within region the same way SetFlip mirrors the text
+func (c *Context) mirror(r, region image.Rectangle) image.Rectangle {
+	if c.flipH {
+		r.Min.X, r.Max.X = region.Min.X+region.Max.X-r.Max.X, region.Min.X+region.Max.X-r.Min.X
+	}
+	if c.flipV {
+		r.Min.Y, r.Max.Y = region.Min.Y+region.Max.Y-r.Max.Y, region.Min.Y+region.Max.Y-r.Min.Y
+	}
+	return r
+}
+
+// flipAlpha returns a copy of mask with the pixels inside of region mirrored. Pixels mirrored in from outside of
+// the mask are left empty
+func flipAlpha(mask *image.Alpha, region image.Rectangle, horizontal, vertical bool) *image.Alpha {
+	flipped := image.NewAlpha(mask.Bounds())
+	copy(flipped.Pix, mask.Pix)
+	visible := region.Intersect(mask.Bounds())
+	for y := visible.Min.Y; y < visible.Max.Y; y++ {
+		for x := visible.Min.X; x < visible.Max.X; x++ {
+			sx, sy := x, y
+			if horizontal {
+				sx = region.Min.X + region.Max.X - 1 - x
+			}
+			if vertical {
+				sy = region.Min.Y + region.Max.Y - 1 - y
+			}
+			flipped.SetAlpha(x, y, mask.AlphaAt(sx, sy))
+		}
+	}
+	return flipped
+}
+
+// downsample scales a supersampled mask down by factor with the supersample filter
+func (c *Context) downsample(mask *image.Alpha, factor int) *image.Alpha {
+	if c.sampleFilter == nil {
+		return downsampleAlpha(mask, factor)
+	}
+	b := mask.Bounds()
+	dst := image.NewAlpha(image.Rect(b.Min.X/factor, b.Min.Y/factor, b.Max.X/factor, b.Max.Y/factor))
+	c.sampleFilter.Scale(dst, dst.Bounds(), mask, b, xdraw.Src, nil)
+	return dst
+}
+
+// downsampleAlpha scales src down by factor, averaging each factor by factor block of pixels into one
+func downsampleAlpha(src *image.Alpha, factor int) *image.Alpha {
+	b := src.Bounds()
+	dst := image.NewAlpha(image.Rect(b.Min.X/factor, b.Min.Y/factor, b.Max.X/factor, b.Max.Y/factor))
+	db := dst.Bounds()
+	for y := db.Min.Y; y < db.Max.Y; y++ {
+		for x := db.Min.X; x < db.Max.X; x++ {
+			sum := 0
+			for sy := y * factor; sy < (y+1)*factor; sy++ {
+				offset := src.PixOffset(x*factor, sy)
+				for _, a := range src.Pix[offset : offset+factor] {
+					sum += int(a)
+				}
+			}
+			dst.Pix[dst.PixOffset(x, y)] = uint8(sum / (factor * factor))
+		}
+	}
+	return dst
+}
+
+// blurRegion writes a Gaussian blur of src with the given radius to the part of dst within rect. Only rect is
+// written to, but pixels of src around it are sampled. dst may be the same image as src
+func blurRegion(dst draw.Image, src image.Image, rect image.Rectangle, radius int) {
+	bounds := src.Bounds()
+	rect = rect.Intersect(bounds).Intersect(dst.Bounds())
+	if rect.Empty() || radius < 1 {
+		return
+	}
+
+	sigma := float64(radius) / 2
+	kernel := make([]float64, 2*radius+1)
+	kernelSum := 0.0
+	for i := range kernel {
+		x := float64(i - radius)
+		kernel[i] = math.Exp(-x * x / (2 * sigma * sigma))
+		kernelSum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= kernelSum
+	}
+
+	clamp := func(v, min, max int) int {
+		if v < min {
+			return min
+		}
+		if v > max {
+			return max
+		}
+		return v
+	}
+
+	// horizontal pass over every row the vertical pass samples
+	minY := clamp(rect.Min.Y-radius, bounds.Min.Y, bounds.Max.Y-1)
+	maxY := clamp(rect.Max.Y+radius, bounds.Min.Y, bounds.Max.Y)
+	width := rect.Dx()
+	rows := make([][4]float64, width*(maxY-minY))
+	for y := minY; y < maxY; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			var acc [4]float64
+			for k, weight := range kernel {
+				r, g, b, a := src.At(clamp(x+k-radius, bounds.Min.X, bounds.Max.X-1), y).RGBA()
+				acc[0] += weight * float64(r)
+				acc[1] += weight * float64(g)
+				acc[2] += weight * float64(b)
+				acc[3] += weight * float64(a)
+			}
+			rows[(y-minY)*width+x-rect.Min.X] = acc
 		}
 	}
 
-	c.src = rgba
-	return nil, rgba
+	// vertical pass from the blurred rows into dst
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			var acc [4]float64
+			for k, weight := range kernel {
+				sy := clamp(y+k-radius, minY, maxY-1)
+				px := rows[(sy-minY)*width+x-rect.Min.X]
+				for i := range acc {
+					acc[i] += weight * px[i]
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(acc[0] + 0.5), uint16(acc[1] + 0.5), uint16(acc[2] + 0.5), uint16(acc[3] + 0.5)})
+		}
+	}
+}
+
+// roundedRectMask returns an anti-aliased coverage mask of rect with its corners rounded by radius
+func roundedRectMask(rect image.Rectangle, radius int32) *image.Alpha {
+	mask := image.NewAlpha(rect)
+	r := math.Min(float64(radius), math.Min(float64(rect.Dx()), float64(rect.Dy()))/2)
+	if r <= 0 {
+		draw.Draw(mask, rect, image.Opaque, image.ZP, draw.Src)
+		return mask
+	}
+	minX, minY := float64(rect.Min.X)+r, float64(rect.Min.Y)+r
+	maxX, maxY := float64(rect.Max.X)-r, float64(rect.Max.Y)-r
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			// distance from the pixel center to the nearest point of the rectangle inset by r
+			px, py := float64(x)+0.5, float64(y)+0.5
+			dx := px - math.Max(minX, math.Min(px, maxX))
+			dy := py - math.Max(minY, math.Min(py, maxY))
+			coverage := math.Max(0, math.Min(1, r-math.Hypot(dx, dy)+0.5))
+			mask.Pix[mask.PixOffset(x, y)] = uint8(coverage*255 + 0.5)
+		}
+	}
+	return mask
 }
@@ -0,0 +1,3386 @@
+/*
+   Copyright (c) 2014 Triple Crown Sports Inc
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+   THE SOFTWARE.
+*/
+
+package Annotate
+
+import (
+	"bytes"
+	"code.google.com/p/freetype-go/freetype"
+	"code.google.com/p/freetype-go/freetype/truetype"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// testFont returns the Go Regular font, which every test draws with
+func testFont(t testing.TB) *truetype.Font {
+	font, err := freetype.ParseFont(goregular.TTF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return font
+}
+
+// filledImage returns a width by height image filled with col
+func filledImage(width, height int, col color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(col), image.ZP, draw.Src)
+	return img
+}
+
+// newTestContext returns a Context with the test font and a white width by height source
+func newTestContext(t testing.TB, width, height int) *Context {
+	c := NewContext()
+	c.SetFont(testFont(t))
+	c.SetSrc(filledImage(width, height, color.White))
+	c.SetMaxFontSize(40)
+	return c
+}
+
+// mustWriteText draws text inside of box and fails the test if it can't be drawn
+func mustWriteText(t testing.TB, c *Context, text string, box Rectangle) image.Image {
+	err, img := c.WriteText(text, box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// isInk reports whether col is darker than the white test sources, i.e. whether text was drawn there
+func isInk(col color.Color) bool {
+	r, g, b, _ := col.RGBA()
+	return r < 0xf000 || g < 0xf000 || b < 0xf000
+}
+
+// inkBounds returns the smallest rectangle holding every pixel of img within r that text was drawn on
+func inkBounds(img image.Image, r image.Rectangle) image.Rectangle {
+	var ink image.Rectangle
+	r = r.Intersect(img.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if isInk(img.At(x, y)) {
+				ink = ink.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return ink
+}
+
+// countInk returns the number of pixels of img within r that text was drawn on
+func countInk(img image.Image, r image.Rectangle) int {
+	count := 0
+	r = r.Intersect(img.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if isInk(img.At(x, y)) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func TestDefaultFontColor(t *testing.T) {
+	c := newTestContext(t, 200, 60)
+	img := mustWriteText(t, c, "Hello", Rectangle{X: 10, Y: 10, Width: 180, Height: 40})
+
+	darkest := uint32(0xffff)
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			if r != g || g != bl {
+				t.Fatalf("pixel at %d,%d is %v, want a shade of gray", x, y, img.At(x, y))
+			}
+			if r < darkest {
+				darkest = r
+			}
+		}
+	}
+	if darkest != 0 {
+		t.Errorf("darkest pixel is %#x, want black text", darkest)
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	c := newTestContext(t, 300, 200)
+	box := Rectangle{X: 10, Y: 10, Width: 150, Height: 180}
+	text := "the quick brown fox jumps over the lazy dog\nagain"
+
+	lines, fontSize, err := c.Layout(text, box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped := c.WrapText(text, box, fontSize)
+	if len(wrapped) != len(lines) {
+		t.Fatalf("WrapText returned %d lines, Layout %d", len(wrapped), len(lines))
+	}
+	for i, line := range lines {
+		if want := strings.Join(line.Words, " "); wrapped[i] != want {
+			t.Errorf("line %d is %q, want %q", i, wrapped[i], want)
+		}
+	}
+	if len(wrapped) < 3 {
+		t.Errorf("got %d lines, want the first sentence wrapped", len(wrapped))
+	}
+	if last := wrapped[len(wrapped)-1]; last != "again" {
+		t.Errorf("last line is %q, want the line after the newline on its own", last)
+	}
+
+	if got := NewContext().WrapText(text, box, fontSize); got != nil {
+		t.Errorf("got %q without a font, want nil", got)
+	}
+}
+
+// isRed reports whether col is mostly red, as drawn by text filled with red
+func isRed(col color.Color) bool {
+	r, g, b, _ := col.RGBA()
+	return r > 0xc000 && g < 0x8000 && b < 0x8000
+}
+
+func TestFontImageMode(t *testing.T) {
+	box := Rectangle{X: 150, Y: 100, Width: 90, Height: 50}
+	for _, mode := range []FillMode{Tile, Stretch} {
+		c := newTestContext(t, 240, 150)
+		c.SetFontImageMode(mode)
+		c.SetFontImage(filledImage(10, 10, color.RGBA{0xff, 0, 0, 0xff}))
+		img := mustWriteText(t, c, "Hello", box)
+
+		red, gray := 0, 0
+		for y := int(box.Y); y < int(box.Y+box.Height); y++ {
+			for x := int(box.X); x < int(box.X+box.Width); x++ {
+				col := img.At(x, y)
+				if isRed(col) {
+					red++
+				} else if r, g, _, _ := col.RGBA(); r != g {
+					continue
+				} else if isInk(col) {
+					gray++
+				}
+			}
+		}
+		if red == 0 || gray > 0 {
+			t.Errorf("mode %d: got %d red and %d gray glyph pixels, want only red", mode, red, gray)
+		}
+	}
+}
+
+func TestDrawLinesAt(t *testing.T) {
+	c := newTestContext(t, 200, 120)
+	img, err := c.DrawLinesAt([]Line{
+		{Words: []string{"HI"}, XPos: 20, YPos: 40},
+		{Words: []string{"HI"}, XPos: 100, YPos: 90},
+	}, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []image.Point{{20, 40}, {100, 90}} {
+		// H and I sit on the baseline and have no descenders
+		ink := inkBounds(img, image.Rect(want.X-10, want.Y-40, want.X+60, want.Y+10))
+		if ink.Max.Y != want.Y {
+			t.Errorf("line at %v: glyphs end at y %d, want them to sit on the baseline", want, ink.Max.Y)
+		}
+		if ink.Min.X < want.X || ink.Min.X > want.X+3 {
+			t.Errorf("line at %v: glyphs start at x %d, want them to start at the pen position", want, ink.Min.X)
+		}
+	}
+}
+
+func TestDrawLinesAtLeavesLines(t *testing.T) {
+	c := newTestContext(t, 300, 200)
+	laidOut, fontSize, err := c.Layout("lines laid out once and drawn twice", Rectangle{X: 10, Y: 10, Width: 280, Height: 180})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make([]Line, len(laidOut))
+	for i, line := range laidOut {
+		lines[i] = *line
+	}
+	before := append([]Line(nil), lines...)
+
+	first, err := c.DrawLinesAt(lines, fontSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lines, before) {
+		t.Error("drawing the lines changed them, want the caller's lines left untouched")
+	}
+	c.SetSrc(filledImage(300, 200, color.White))
+	second, err := c.DrawLinesAt(lines, fontSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Error("drawing the same lines twice gave different images")
+	}
+}
+
+func TestTextBackgroundRounded(t *testing.T) {
+	c := newTestContext(t, 200, 100)
+	c.SetMaxFontSize(10)
+	panel := color.RGBA{0, 0, 0xff, 0xff}
+	c.SetTextBackgroundRounded(Color{0, 0, 0xffff, 0xffff}, 12)
+	box := Rectangle{X: 20, Y: 20, Width: 160, Height: 60}
+	img := mustWriteText(t, c, "a", box)
+
+	r := box.Rect()
+	for _, corner := range []image.Point{r.Min, {r.Max.X - 1, r.Min.Y}, {r.Min.X, r.Max.Y - 1}, r.Max.Sub(image.Pt(1, 1))} {
+		if got := color.RGBAModel.Convert(img.At(corner.X, corner.Y)); got != (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+			t.Errorf("corner %v is %v, want it left unfilled", corner, got)
+		}
+	}
+	// the text is small and left aligned, so the right edge of the panel is clear of it
+	for _, inside := range []image.Point{{r.Max.X - 2, r.Min.Y + r.Dy()/2}, {r.Max.X - 30, r.Max.Y - 2}} {
+		if got := color.RGBAModel.Convert(img.At(inside.X, inside.Y)); got != panel {
+			t.Errorf("pixel %v is %v, want the panel color", inside, got)
+		}
+	}
+}
+
+func TestSubPixelCentering(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 201, Height: 60}
+	center := float64(box.X) + float64(box.Width)/2
+
+	// how far the center of the single line text is laid out at is from the center of the box
+	centerError := func(subPixel bool, text string) float64 {
+		c := newTestContext(t, 240, 80)
+		c.SetMaxFontSize(20)
+		c.SetAlignment(CENTERED)
+		c.SetSubPixel(subPixel)
+		lines, _, err := c.Layout(text, box)
+		if err != nil {
+			t.Fatal(err)
+		}
+		line := lines[0]
+		return math.Abs(float64(line.XPos) + line.xFrac + float64(line.currWidth)/2 - center)
+	}
+
+	integerError := 0.0
+	for _, text := range []string{"a", "ab", "abc", "abcd", "abcde"} {
+		integerError = math.Max(integerError, centerError(false, text))
+		if got := centerError(true, text); got > 1e-9 {
+			t.Errorf("%q is off center by %v pixels with sub-pixel positioning, want 0", text, got)
+		}
+	}
+	if integerError == 0 {
+		t.Error("no text was off center without sub-pixel positioning, the test doesn't compare anything")
+	}
+}
+
+func TestTruncateToWidth(t *testing.T) {
+	c := newTestContext(t, 100, 100)
+	const fontSize = 20
+	ellipsis := "…"
+
+	for _, s := range []string{"héllo wörld ünïcode", "日本語のテキストです", "cafe\u0301 cafe\u0301 cafe\u0301 cafe\u0301"} {
+		full := c.runesWidth([]rune(s), fontSize)
+		if got := c.TruncateToWidth(s, full, fontSize, ellipsis); got != s {
+			t.Errorf("%q truncated to %q at its own width, want it unchanged", s, got)
+		}
+
+		maxWidth := full / 2
+		got := c.TruncateToWidth(s, maxWidth, fontSize, ellipsis)
+		if !utf8.ValidString(got) {
+			t.Errorf("%q truncated to invalid UTF-8 %q", s, got)
+		}
+		prefix := strings.TrimSuffix(got, ellipsis)
+		if prefix == got || !strings.HasPrefix(s, prefix) || prefix == "" {
+			t.Errorf("%q truncated to %q, want a prefix followed by the ellipsis", s, got)
+		}
+		if width := c.runesWidth([]rune(got), fontSize); width > maxWidth {
+			t.Errorf("%q truncated to %q, which is %d wide, want at most %d", s, got, width, maxWidth)
+		}
+		if rest := []rune(s[len(prefix):]); len(rest) > 0 && isMark(rest[0]) {
+			t.Errorf("%q truncated to %q, which separates a combining mark from its base", s, got)
+		}
+	}
+
+	if got := NewContext().TruncateToWidth("abc", 1, fontSize, ellipsis); got != "abc" {
+		t.Errorf("got %q without a font, want the text unchanged", got)
+	}
+}
+
+func TestAntialiasDisabled(t *testing.T) {
+	c := newTestContext(t, 200, 80)
+	c.SetAntialias(false)
+	img := mustWriteText(t, c, "Sharp edges", Rectangle{X: 10, Y: 10, Width: 180, Height: 60})
+
+	if countInk(img, img.Bounds()) == 0 {
+		t.Fatal("no text was drawn")
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if r, _, _, _ := img.At(x, y).RGBA(); r != 0 && r != 0xffff {
+				t.Fatalf("pixel at %d,%d is %#x, want only fully covered or uncovered pixels", x, y, r)
+			}
+		}
+	}
+}
+
+// tempDir returns a new temporary directory that is removed when the test ends
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "annotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// writeFile writes data to name inside of dir and fails the test if it can't
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSetFontFromDir(t *testing.T) {
+	dir := tempDir(t)
+	writeFile(t, dir, "a-readme.txt", []byte("not a font"))
+	if err := os.Mkdir(filepath.Join(dir, "a-dir.ttf"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, dir, "regular.TTF", goregular.TTF)
+
+	c := NewContext()
+	if err := c.SetFontFromDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if c.font == nil || !c.CanRender('a') {
+		t.Error("the font in the directory wasn't loaded")
+	}
+
+	if err := NewContext().SetFontFromDir(tempDir(t)); err == nil {
+		t.Error("got no error for a directory without fonts")
+	}
+}
+
+func TestWriteLine(t *testing.T) {
+	c := newTestContext(t, 200, 100)
+	img, err := c.WriteLine("HELLO", 30, 70, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ink := inkBounds(img, img.Bounds())
+	if ink.Max.Y != 70 {
+		t.Errorf("glyphs end at y %d, want them to sit on the baseline at 70", ink.Max.Y)
+	}
+	if ink.Min.X < 30 || ink.Min.X > 33 {
+		t.Errorf("glyphs start at x %d, want them to start at 30", ink.Min.X)
+	}
+}
+
+func TestBottomPadding(t *testing.T) {
+	fontSize := func(padding int32) int32 {
+		c := newTestContext(t, 200, 100)
+		c.SetMaxFontSize(100)
+		c.SetBottomPadding(padding)
+		result, err := c.Render("Padded", Rectangle{X: 0, Y: 0, Width: 200, Height: 60})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.FontSize
+	}
+
+	unpadded, padded := fontSize(0), fontSize(20)
+	if padded >= unpadded {
+		t.Errorf("got font size %d with padding and %d without, want a smaller size with padding", padded, unpadded)
+	}
+}
+
+func TestFitAtMax(t *testing.T) {
+	for _, test := range []struct {
+		text     string
+		fitAtMax bool
+	}{
+		{"Hi", true},
+		{"This text is far too long to fit inside of the box at the max font size", false},
+	} {
+		c := newTestContext(t, 300, 100)
+		c.SetMaxFontSize(20)
+		result, err := c.Render(test.text, Rectangle{X: 10, Y: 10, Width: 280, Height: 40})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.FitAtMax != test.fitAtMax {
+			t.Errorf("%q: FitAtMax is %v, want %v", test.text, result.FitAtMax, test.fitAtMax)
+		}
+		if atMax := result.FontSize == 20; atMax != test.fitAtMax {
+			t.Errorf("%q: drawn at font size %d with FitAtMax %v", test.text, result.FontSize, result.FitAtMax)
+		}
+	}
+}
+
+func TestWriteTextDPI(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 380, Height: 180}
+	inkAt := func(dpi float64) image.Rectangle {
+		c := newTestContext(t, 400, 200)
+		c.SetMaxFontSize(20)
+		img, err := c.WriteTextDPI("HH", box, dpi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inkBounds(img, img.Bounds())
+	}
+
+	low, high := inkAt(72), inkAt(144)
+	for _, ratio := range []float64{float64(high.Dx()) / float64(low.Dx()), float64(high.Dy()) / float64(low.Dy())} {
+		if ratio < 1.8 || ratio > 2.2 {
+			t.Errorf("text is %v at 72 DPI and %v at 144 DPI, want it twice the size", low.Size(), high.Size())
+		}
+	}
+	// the text is laid out at the DPI it is drawn at, so it stays inside of the box
+	if !high.In(box.Rect()) {
+		t.Errorf("text drawn at %v at 144 DPI, want it inside of the box %v", high, box.Rect())
+	}
+}
+
+// isYellow reports whether col is the default highlight color
+func isYellow(col color.Color) bool {
+	r, g, b, _ := col.RGBA()
+	return r > 0xf000 && g > 0xf000 && b < 0x1000
+}
+
+func TestWriteTextHighlighted(t *testing.T) {
+	c := newTestContext(t, 300, 80)
+	box := Rectangle{X: 10, Y: 10, Width: 280, Height: 60}
+	text := "one two three"
+	boxes, err := c.GlyphBoxes(text, box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var word image.Rectangle
+	for _, glyph := range boxes[4:7] {
+		word = word.Union(glyph.Rect)
+	}
+
+	img, err := c.WriteTextHighlighted(text, box, map[int]bool{1: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inside, outside := 0, 0
+	// the highlight may differ from the glyph boxes by the kerning with the spaces around the word
+	allowed := word.Inset(-2)
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if !isYellow(img.At(x, y)) {
+				continue
+			}
+			if image.Pt(x, y).In(allowed) {
+				inside++
+			} else {
+				outside++
+			}
+		}
+	}
+	if inside < word.Dx()*word.Dy()/2 {
+		t.Errorf("%d pixels of the word %v are highlighted, want most of them", inside, word)
+	}
+	if outside > 0 {
+		t.Errorf("%d pixels outside of the word %v are highlighted, want none", outside, word)
+	}
+}
+
+func TestEmptyText(t *testing.T) {
+	for _, text := range []string{"", "   ", "\n\n"} {
+		c := newTestContext(t, 100, 60)
+		result, err := c.Render(text, Rectangle{X: 10, Y: 10, Width: 80, Height: 40})
+		if err != nil {
+			t.Errorf("%q: %v", text, err)
+			continue
+		}
+		if n := countInk(result.Image, result.Image.Bounds()); n > 0 {
+			t.Errorf("%q: %d pixels were drawn, want none", text, n)
+		}
+		if result.Image.Bounds() != image.Rect(0, 0, 100, 60) {
+			t.Errorf("%q: got an image with bounds %v, want the source's", text, result.Image.Bounds())
+		}
+	}
+}
+
+// stripes is an image.Image, but not a draw.Image, of vertical red and blue stripes 4 pixels wide
+type stripes struct{}
+
+func (stripes) ColorModel() color.Model { return color.RGBAModel }
+
+func (stripes) Bounds() image.Rectangle { return image.Rect(0, 0, 8, 8) }
+
+func (stripes) At(x, y int) color.Color {
+	if x%8 < 4 {
+		return color.RGBA{0xff, 0, 0, 0xff}
+	}
+	return color.RGBA{0, 0, 0xff, 0xff}
+}
+
+func TestSetFontFillImage(t *testing.T) {
+	c := newTestContext(t, 300, 100)
+	c.SetAntialias(false)
+	c.SetFontFillImage(stripes{})
+	img := mustWriteText(t, c, "Striped", Rectangle{X: 10, Y: 10, Width: 280, Height: 80})
+
+	drawn := 0
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			got := color.RGBAModel.Convert(img.At(x, y))
+			if got == (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+				continue
+			}
+			drawn++
+			if want := (stripes{}).At(x, y); got != want {
+				t.Fatalf("pixel at %d,%d is %v, want %v from the fill image", x, y, got, want)
+			}
+		}
+	}
+	if drawn == 0 {
+		t.Error("no text was drawn")
+	}
+}
+
+func TestRenderIterations(t *testing.T) {
+	for _, maxFontSize := range []int{16, 100, 200, 1000} {
+		c := newTestContext(t, 300, 200)
+		c.SetMaxFontSize(maxFontSize)
+		result, err := c.Render("Some text that has to be shrunk to fit", Rectangle{X: 10, Y: 10, Width: 280, Height: 60})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bound := int32(math.Ceil(math.Log2(float64(maxFontSize)))) + 2
+		if result.Iterations < 1 || result.Iterations > bound {
+			t.Errorf("max font size %d: took %d iterations, want at most %d", maxFontSize, result.Iterations, bound)
+		}
+	}
+}
+
+func TestJustifiedParagraphs(t *testing.T) {
+	c := newTestContext(t, 300, 300)
+	c.SetMaxFontSize(16)
+	c.SetAlignment(JUSTIFIED)
+	box := Rectangle{X: 10, Y: 10, Width: 200, Height: 280}
+	text := "the first paragraph has enough words in it to wrap over a few lines\n" +
+		"and so does the second paragraph, which also wraps over a few lines"
+	lines, _, err := c.Layout(text, box)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paragraphs := 0
+	for i, line := range lines {
+		if line.ParagraphEnd {
+			paragraphs++
+			if line.extraSpace != 0 || line.XPos != box.X {
+				t.Errorf("last line %d of a paragraph starts at %d with %d extra space, want it left aligned",
+					i, line.XPos, line.extraSpace)
+			}
+		} else if line.extraSpace == 0 {
+			t.Errorf("wrapped line %d isn't justified", i)
+		}
+	}
+	if paragraphs != 2 || len(lines) < 4 {
+		t.Fatalf("got %d lines in %d paragraphs, want both paragraphs wrapped", len(lines), paragraphs)
+	}
+
+	// highlights are drawn behind justified words where they are drawn
+	boxes, err := c.GlyphBoxes(text, box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var word image.Rectangle
+	for _, glyph := range boxes[len("the first "):len("the first paragraph")] {
+		word = word.Union(glyph.Rect)
+	}
+	img, err := c.WriteTextHighlighted(text, box, map[int]bool{2: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := word.Inset(-2)
+	highlighted := 0
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if !isYellow(img.At(x, y)) {
+				continue
+			}
+			if !image.Pt(x, y).In(allowed) {
+				t.Fatalf("pixel at %d,%d is highlighted, want only the word at %v", x, y, word)
+			}
+			highlighted++
+		}
+	}
+	if highlighted < word.Dx()*word.Dy()/2 {
+		t.Errorf("%d pixels of the word %v are highlighted, want most of them", highlighted, word)
+	}
+}
+
+func TestSupersample(t *testing.T) {
+	box := Rectangle{X: 5, Y: 5, Width: 190, Height: 50}
+	// renders small text and returns where it was drawn and how many different shades its edges have
+	edges := func(factor int) (image.Rectangle, int) {
+		c := newTestContext(t, 200, 60)
+		c.SetMaxFontSize(10)
+		c.SetSupersample(factor)
+		img := mustWriteText(t, c, "Small text", box)
+		shades := map[uint32]bool{}
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if r, _, _, _ := img.At(x, y).RGBA(); r < 0xffff {
+					shades[r>>8] = true
+				}
+			}
+		}
+		return inkBounds(img, b), len(shades)
+	}
+
+	plainInk, plainShades := edges(1)
+	sampledInk, sampledShades := edges(4)
+	if sampledShades <= plainShades {
+		t.Errorf("edges have %d shades supersampled and %d without, want smoother edges supersampled",
+			sampledShades, plainShades)
+	}
+	// the text is the same size and in the same place either way
+	for _, d := range []int{
+		sampledInk.Min.X - plainInk.Min.X, sampledInk.Max.X - plainInk.Max.X,
+		sampledInk.Min.Y - plainInk.Min.Y, sampledInk.Max.Y - plainInk.Max.Y,
+	} {
+		if d < -2 || d > 2 {
+			t.Fatalf("text drawn at %v supersampled and %v without, want the same place", sampledInk, plainInk)
+		}
+	}
+}
+
+func TestSetInPlace(t *testing.T) {
+	c := newTestContext(t, 200, 60)
+	src := c.src.(*image.RGBA)
+	c.SetInPlace(true)
+	img := mustWriteText(t, c, "In place", Rectangle{X: 10, Y: 10, Width: 180, Height: 40})
+
+	if drawn, ok := img.(*image.RGBA); !ok || drawn != src {
+		t.Error("got a new image, want the source drawn on")
+	}
+	if countInk(src, src.Bounds()) == 0 {
+		t.Error("no text was drawn on the source")
+	}
+}
+
+func BenchmarkWriteTextInPlace(b *testing.B) {
+	for _, inPlace := range []bool{false, true} {
+		name := "copy"
+		if inPlace {
+			name = "in-place"
+		}
+		b.Run(name, func(b *testing.B) {
+			c := newTestContext(b, 1920, 1080)
+			c.SetInPlace(inPlace)
+			box := Rectangle{X: 100, Y: 100, Width: 800, Height: 200}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err, _ := c.WriteText("Benchmark", box); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestLayoutColumns(t *testing.T) {
+	c := newTestContext(t, 420, 120)
+	box := Rectangle{X: 10, Y: 10, Width: 400, Height: 100}
+	const gutter, fontSize = 20, 12
+	text := strings.Repeat("words flowing down one column and on into the next ", 4)
+	lines, fits := c.layoutColumns(text, box, 2, gutter, fontSize)
+	if !fits {
+		t.Fatal("the text doesn't fit, want it to fill both columns")
+	}
+
+	secondX := box.X + (box.Width-gutter)/2 + gutter
+	first, second := 0, 0
+	for i, line := range lines {
+		if line.XPos < secondX {
+			if second > 0 {
+				t.Fatalf("line %d is back in the first column after the second one started", i)
+			}
+			first++
+		} else {
+			second++
+		}
+		if bottom := line.YPos + c.descentSpace(fontSize); bottom > box.Y+box.Height {
+			t.Errorf("line %d ends at %d, below the box", i, bottom)
+		}
+	}
+	if first == 0 || second == 0 || second > first {
+		t.Fatalf("got %d lines in the first column and %d in the second, want the first filled", first, second)
+	}
+	if lines[0].YPos != lines[first].YPos {
+		t.Errorf("the columns start at baselines %d and %d, want the same", lines[0].YPos, lines[first].YPos)
+	}
+	// the first column holds as many lines as fit
+	if height := c.linesHeight(box, lines[:first+1], fontSize); height <= box.Height {
+		t.Errorf("%d lines are %d high, which would still fit in the first column", first+1, height)
+	}
+}
+
+func TestGlyphBoxes(t *testing.T) {
+	for _, alignment := range []int{LEFT_ALIGNED, JUSTIFIED} {
+		c := newTestContext(t, 300, 200)
+		c.SetDPI(144)
+		c.SetMaxFontSize(12)
+		c.SetAlignment(alignment)
+		box := Rectangle{X: 10, Y: 10, Width: 280, Height: 180}
+		text := "glyph boxes follow the pen from left to right across every wrapped line"
+		boxes, err := c.GlyphBoxes(text, box)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the spaces lines are broken at aren't drawn
+		lines := boxes[len(boxes)-1].Line + 1
+		if want := len([]rune(text)) - (lines - 1); len(boxes) != want || lines < 2 {
+			t.Fatalf("got %d boxes on %d lines, want %d on more than one line", len(boxes), lines, want)
+		}
+
+		result, err := c.Render(text, box)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, glyph := range boxes {
+			if i+1 == len(boxes) || boxes[i+1].Line != glyph.Line {
+				// the last box of a line ends where the pen did
+				if end := result.LineEnds[glyph.Line].X; glyph.Rect.Max.X != end {
+					t.Errorf("alignment %d: line %d ends at %d, want %d", alignment, glyph.Line, glyph.Rect.Max.X, end)
+				}
+				continue
+			}
+			next := boxes[i+1]
+			if next.Rect.Min.X != glyph.Rect.Max.X {
+				t.Errorf("alignment %d: %q at %v is followed by %q at %v, want the boxes side by side",
+					alignment, glyph.Rune, glyph.Rect, next.Rune, next.Rect)
+			}
+			if glyph.Rect.Empty() && glyph.Rune != ' ' {
+				t.Errorf("alignment %d: %q has an empty box", alignment, glyph.Rune)
+			}
+		}
+
+		// every glyph is drawn inside of the boxes of its line, give or take its overhang
+		lineRects := make([]image.Rectangle, lines)
+		for _, glyph := range boxes {
+			lineRects[glyph.Line] = lineRects[glyph.Line].Union(glyph.Rect.Inset(-2))
+		}
+		img := result.Image
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				inside := false
+				for _, r := range lineRects {
+					inside = inside || image.Pt(x, y).In(r)
+				}
+				if isInk(img.At(x, y)) && !inside {
+					t.Fatalf("alignment %d: pixel at %d,%d was drawn outside of every glyph box", alignment, x, y)
+				}
+			}
+		}
+	}
+}
+
+func TestWriteTextOnto(t *testing.T) {
+	for _, inPlace := range []bool{false, true} {
+		frame := image.NewPaletted(image.Rect(0, 0, 200, 60), color.Palette{color.White, color.Black, color.RGBA{0xff, 0, 0, 0xff}})
+		c := newTestContext(t, 1, 1)
+		c.SetInPlace(inPlace)
+		if err := c.WriteTextOnto(frame, "Frame", Rectangle{X: 10, Y: 10, Width: 180, Height: 40}); err != nil {
+			t.Fatal(err)
+		}
+
+		black := 0
+		for _, index := range frame.Pix {
+			if int(index) >= len(frame.Palette) {
+				t.Fatalf("in place %v: got color index %d, want one of the %d colors of the palette", inPlace, index, len(frame.Palette))
+			}
+			if index == 1 {
+				black++
+			}
+		}
+		if black == 0 {
+			t.Errorf("in place %v: no text was drawn onto the frame", inPlace)
+		}
+	}
+}
+
+func TestFitStrategy(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 100, Height: 180}
+	const word = "Unbreakable"
+	sizes := map[FitStrategy]int32{}
+	for _, strategy := range []FitStrategy{FitHeight, FitWidth, FitWidthAndHeight} {
+		c := newTestContext(t, 120, 200)
+		c.SetMaxFontSize(60)
+		c.SetFitStrategy(strategy)
+		result, err := c.Render(word, box)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[strategy] = result.FontSize
+		if width := c.runesWidth([]rune(word), result.FontSize); strategy != FitHeight && width > box.Width {
+			t.Errorf("strategy %d: the word is %d wide at size %d, want it to fit in %d", strategy, width, result.FontSize, box.Width)
+		}
+	}
+	if sizes[FitWidth] >= sizes[FitHeight] || sizes[FitWidthAndHeight] != sizes[FitWidth] {
+		t.Errorf("got sizes %v, want the width to shrink the text", sizes)
+	}
+}
+
+func TestParagraphSpacing(t *testing.T) {
+	c := newTestContext(t, 200, 400)
+	c.SetMaxFontSize(12)
+	c.SetParagraphSpacing(1)
+	box := Rectangle{X: 10, Y: 10, Width: 180, Height: 380}
+	lines, _, err := c.Layout("a first paragraph long enough to wrap onto more lines\nthe second paragraph", box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := -1
+	for i, line := range lines {
+		if line.ParagraphEnd {
+			start = i + 1
+			break
+		}
+	}
+	if start < 2 || start >= len(lines) {
+		t.Fatalf("the second paragraph starts at line %d of %d, want it after a wrapped first paragraph", start, len(lines))
+	}
+	wrapped := lines[1].YPos - lines[0].YPos
+	if gap := lines[start].YPos - lines[start-1].YPos; gap <= wrapped {
+		t.Errorf("got a gap of %d after the paragraph and %d between wrapped lines, want the first larger", gap, wrapped)
+	}
+}
+
+func TestSetSrcPathSniffsFormat(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, filledImage(30, 20, color.White), nil); err != nil {
+		t.Fatal(err)
+	}
+	dir := tempDir(t)
+	path := writeFile(t, dir, "photo.png", buf.Bytes())
+
+	for _, maxPixels := range []int{0, 1000} {
+		c := NewContext()
+		c.SetMaxPixels(maxPixels)
+		if err := c.SetSrcPath(path); err != nil {
+			t.Fatalf("max pixels %d: %v", maxPixels, err)
+		}
+		if got := c.src.Bounds(); got != image.Rect(0, 0, 30, 20) {
+			t.Errorf("max pixels %d: got bounds %v, want the 30x20 JPEG", maxPixels, got)
+		}
+	}
+
+	text := writeFile(t, dir, "notes.png", []byte("not an image"))
+	var unsupported UnsupportedError
+	if err := NewContext().SetSrcPath(text); !errors.As(err, &unsupported) {
+		t.Errorf("got %v for a file that isn't an image, want an UnsupportedError", err)
+	}
+}
+
+func TestClone(t *testing.T) {
+	c := newTestContext(t, 200, 60)
+	c.SetInPlace(false)
+	clone := c.Clone()
+	clone.SetFontColor(Color{0xffff, 0, 0, 0xffff})
+	box := Rectangle{X: 10, Y: 10, Width: 180, Height: 40}
+
+	img := mustWriteText(t, c, "Original", box)
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if isRed(img.At(x, y)) {
+				t.Fatalf("pixel at %d,%d of the original is red, want the clone's color kept to the clone", x, y)
+			}
+		}
+	}
+
+	img = mustWriteText(t, clone, "Clone", box)
+	red := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if isRed(img.At(x, y)) {
+				red++
+			}
+		}
+	}
+	if red == 0 {
+		t.Error("the clone drew no red text")
+	}
+}
+
+func TestTrimTrailingSpace(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 300, Height: 100}
+	var positions [2]int32
+	var widths [2]int32
+	for i, trim := range []bool{false, true} {
+		c := newTestContext(t, 320, 120)
+		c.SetMaxFontSize(12)
+		c.SetAlignment(CENTERED)
+		c.SetTrimTrailingSpace(trim)
+		lines, _, err := c.Layout("Centered", box)
+		if err != nil {
+			t.Fatal(err)
+		}
+		positions[i], widths[i] = lines[0].XPos, lines[0].currWidth
+	}
+	if widths[1] >= widths[0] {
+		t.Errorf("got widths %d untrimmed and %d trimmed, want the trailing space left out", widths[0], widths[1])
+	}
+	// centering the narrower line moves it right by half of the space that was left out
+	if shift := (widths[0] - widths[1]) / 2; positions[1]-positions[0] < shift-1 || positions[1]-positions[0] > shift+1 {
+		t.Errorf("got the line at %d untrimmed and %d trimmed, want it moved by about %d", positions[0], positions[1], shift)
+	}
+}
+
+func TestUnicodeSpaces(t *testing.T) {
+	c := newTestContext(t, 100, 100)
+	box := Rectangle{X: 0, Y: 0, Width: 1, Height: 100}
+	text := "one\u2003two\u3000three\u2009four\tfive\u00a0six\u202fseven"
+	got := c.WrapText(text, box, 12)
+	want := []string{"one", "two", "three", "four", "five\u00a0six\u202fseven"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got lines %q, want %q", got, want)
+	}
+}
+
+func TestFontImageOffset(t *testing.T) {
+	// the left half of the fill is red and the right half blue
+	fill := filledImage(200, 60, color.RGBA{0, 0, 0xff, 0xff})
+	draw.Draw(fill, image.Rect(0, 0, 100, 60), image.NewUniform(color.RGBA{0xff, 0, 0, 0xff}), image.ZP, draw.Src)
+	box := Rectangle{X: 110, Y: 10, Width: 80, Height: 40}
+
+	for _, offset := range []int{0, 100} {
+		c := newTestContext(t, 200, 60)
+		c.SetAntialias(false)
+		c.SetFontImage(fill)
+		c.SetFontImageOffset(offset, 0)
+		img := mustWriteText(t, c, "Offset", box)
+
+		want := fill.At(int(box.X), 0)
+		if offset != 0 {
+			want = fill.At(int(box.X)-offset, 0)
+		}
+		drawn := 0
+		for y := 0; y < 60; y++ {
+			for x := 0; x < 200; x++ {
+				got := color.RGBAModel.Convert(img.At(x, y))
+				if got == (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+					continue
+				}
+				drawn++
+				if got != want {
+					t.Fatalf("offset %d: pixel at %d,%d is %v, want %v", offset, x, y, got, want)
+				}
+			}
+		}
+		if drawn == 0 {
+			t.Errorf("offset %d: no text was drawn", offset)
+		}
+	}
+}
+
+func TestAnnotateFile(t *testing.T) {
+	dir := tempDir(t)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, filledImage(200, 80, color.White)); err != nil {
+		t.Fatal(err)
+	}
+	srcPath := writeFile(t, dir, "src.png", buf.Bytes())
+	fontPath := writeFile(t, dir, "font.ttf", goregular.TTF)
+	outPath := filepath.Join(dir, "out.png")
+	box := Rectangle{X: 10, Y: 10, Width: 180, Height: 60}
+
+	err := AnnotateFile(srcPath, fontPath, "Hello", box, outPath, WithFontColor(Color{0xffff, 0, 0, 0xffff}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	red := 0
+	for y := 0; y < 80; y++ {
+		for x := 0; x < 200; x++ {
+			if isRed(img.At(x, y)) {
+				red++
+				// give or take the overhang of the last glyph
+				if !image.Pt(x, y).In(box.Rect().Inset(-2)) {
+					t.Fatalf("pixel at %d,%d is outside of the bounding box", x, y)
+				}
+			}
+		}
+	}
+	if red == 0 {
+		t.Error("no text was drawn")
+	}
+
+	missing := filepath.Join(dir, "missing.ttf")
+	if err := AnnotateFile(srcPath, missing, "Caption", box, outPath); !os.IsNotExist(err) {
+		t.Errorf("got %v for a missing font, want the error opening it", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 80, Height: 40}
+	noSource := NewContext()
+	noSource.SetFont(testFont(t))
+	tests := []struct {
+		name string
+		c    *Context
+		text string
+		box  Rectangle
+		want error
+	}{
+		{"no font", NewContext(), "text", box, ErrNoFont},
+		{"no source", noSource, "text", box, ErrNoSource},
+		{"overflow", newTestContext(t, 100, 60), strings.Repeat("line\n", 100), box, ErrTextOverflow},
+		{"invalid box", newTestContext(t, 100, 60), "text", Rectangle{X: 10, Y: 10, Width: 80}, ErrInvalidBox},
+	}
+	for _, test := range tests {
+		_, err := test.c.Render(test.text, test.box)
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+		if wrapped := fmt.Errorf("annotating: %w", err); !errors.Is(wrapped, test.want) {
+			t.Errorf("%s: %v doesn't match %v once wrapped", test.name, wrapped, test.want)
+		}
+	}
+}
+
+func TestTextOverflow(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 80, Height: 40}
+	text := strings.Repeat("line\n", 100)
+	items := strings.Split(strings.TrimSpace(text), "\n")
+	entryPoints := map[string]func(c *Context) error{
+		"Render": func(c *Context) error {
+			_, err := c.Render(text, box)
+			return err
+		},
+		"RenderMask": func(c *Context) error {
+			_, err := c.RenderMask(text, box)
+			return err
+		},
+		"RenderSVG": func(c *Context) error {
+			_, err := c.RenderSVG(text, box)
+			return err
+		},
+		"Layout": func(c *Context) error {
+			_, _, err := c.Layout(text, box)
+			return err
+		},
+		"GlyphBoxes": func(c *Context) error {
+			_, err := c.GlyphBoxes(text, box)
+			return err
+		},
+		"WriteTextHighlighted": func(c *Context) error {
+			_, err := c.WriteTextHighlighted(text, box, map[int]bool{0: true})
+			return err
+		},
+		"WriteTextWithSpans": func(c *Context) error {
+			_, _, err := c.WriteTextWithSpans(text, box, []Span{{Start: 0, End: 4}})
+			return err
+		},
+		"WriteTextColumns": func(c *Context) error {
+			_, err := c.WriteTextColumns(text, box, 2, 4)
+			return err
+		},
+		"WriteList": func(c *Context) error {
+			_, err := c.WriteList(items, box, DiscMarker)
+			return err
+		},
+		"WriteRichText": func(c *Context) error {
+			_, err := c.WriteRichText([]TextRun{{Text: text}}, box)
+			return err
+		},
+		"WriteLabel": func(c *Context) error {
+			c.SetMinFontSize(10)
+			_, _, err := c.WriteLabel("label", Rectangle{X: 10, Y: 10, Width: 80, Height: 2})
+			return err
+		},
+	}
+	for name, write := range entryPoints {
+		if err := write(newTestContext(t, 100, 60)); err != ErrTextOverflow {
+			t.Errorf("%s: got %v for text that doesn't fit at any size, want ErrTextOverflow", name, err)
+		}
+	}
+}
+
+func TestInvalidBox(t *testing.T) {
+	c := newTestContext(t, 100, 60)
+	for _, box := range []Rectangle{
+		{X: 10, Y: 10, Width: 0, Height: 40},
+		{X: 10, Y: 10, Width: -5, Height: 40},
+		{X: 200, Y: 10, Width: 80, Height: 40},
+		{X: 10, Y: -50, Width: 80, Height: 50},
+	} {
+		if _, err := c.Render("text", box); err != ErrInvalidBox {
+			t.Errorf("box %+v: got %v, want ErrInvalidBox", box, err)
+		}
+	}
+
+	// a box hanging off the bottom is fitted to the part inside of the source when clamped
+	box := Rectangle{X: 10, Y: 30, Width: 80, Height: 100}
+	var sizes [2]int32
+	for i, clamp := range []bool{false, true} {
+		c := newTestContext(t, 100, 60)
+		c.SetClampBox(clamp)
+		result, err := c.Render("text", box)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[i] = result.FontSize
+	}
+	if sizes[1] >= sizes[0] {
+		t.Errorf("got font size %d clamped and %d not, want the clamped box to fit smaller text", sizes[1], sizes[0])
+	}
+}
+
+func TestSetFontVariation(t *testing.T) {
+	if err := NewContext().SetFontVariation("wght", 700); err != ErrNoFont {
+		t.Errorf("got %v without a font, want ErrNoFont", err)
+	}
+	c := newTestContext(t, 100, 60)
+	if err := c.SetFontVariation("wght", 700); !errors.Is(err, ErrVariableFontUnsupported) {
+		t.Errorf("got %v, want ErrVariableFontUnsupported", err)
+	}
+	// the default instance is still drawn
+	img := mustWriteText(t, c, "text", Rectangle{X: 10, Y: 10, Width: 80, Height: 40})
+	if countInk(img, img.Bounds()) == 0 {
+		t.Error("no text was drawn after the variation was refused")
+	}
+}
+
+func TestWriteCaption(t *testing.T) {
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	white := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	for _, pos := range []CaptionPosition{CaptionTop, CaptionBottom} {
+		c := newTestContext(t, 200, 100)
+		img, err := c.WriteCaption("Caption", pos, 30, Color{0, 0, 0xffff, 0xffff})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bar := image.Rect(0, 0, 200, 30)
+		if pos == CaptionBottom {
+			bar = image.Rect(0, 70, 200, 100)
+		}
+
+		text := 0
+		for y := 0; y < 100; y++ {
+			for x := 0; x < 200; x++ {
+				got := color.RGBAModel.Convert(img.At(x, y))
+				switch {
+				case !image.Pt(x, y).In(bar):
+					if got != white {
+						t.Fatalf("position %d: pixel at %d,%d is %v outside of the bar, want it untouched", pos, x, y, got)
+					}
+				case got != blue:
+					text++
+				}
+			}
+		}
+		if text == 0 {
+			t.Errorf("position %d: the bar has no text in it", pos)
+		}
+		if got := color.RGBAModel.Convert(img.At(1, bar.Min.Y+1)); got != blue {
+			t.Errorf("position %d: the corner of the bar is %v, want it filled", pos, got)
+		}
+	}
+}
+
+func TestSetFontSizeRelative(t *testing.T) {
+	var sizes []int32
+	for _, height := range []int{100, 400} {
+		c := newTestContext(t, 1000, height)
+		c.SetFontSizeRelative(0.1)
+		result, err := c.Render("Hi", Rectangle{X: 0, Y: 0, Width: 1000, Height: int32(height)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.FitAtMax {
+			t.Fatalf("height %d: the text was shrunk to %d, want it at the maximum size", height, result.FontSize)
+		}
+		sizes = append(sizes, result.FontSize)
+	}
+	if sizes[0] != 10 || sizes[1] != 40 {
+		t.Errorf("got sizes %v, want 10%% of each image's height", sizes)
+	}
+}
+
+func TestSetBreakFunc(t *testing.T) {
+	c := newTestContext(t, 300, 200)
+	box := Rectangle{X: 0, Y: 0, Width: 25, Height: 200}
+	text := "in / out and up / down"
+	if got := c.WrapText(text, box, 12); len(got) < 5 {
+		t.Fatalf("got lines %q, want most words on lines of their own by default", got)
+	}
+
+	// keep the words on either side of a slash together
+	c.SetBreakFunc(func(prev, next string) bool {
+		return prev != "/" && next != "/"
+	})
+	got := c.WrapText(text, box, 12)
+	want := []string{"in / out", "and", "up / down"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got lines %q, want %q", got, want)
+	}
+}
+
+// variance returns the variance of the red channel of img over r
+func variance(img image.Image, r image.Rectangle) float64 {
+	var sum, squares float64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			red, _, _, _ := img.At(x, y).RGBA()
+			v := float64(red >> 8)
+			sum += v
+			squares += v * v
+		}
+	}
+	n := float64(r.Dx() * r.Dy())
+	mean := sum / n
+	return squares/n - mean*mean
+}
+
+func TestBackdropBlur(t *testing.T) {
+	// a checkerboard of two grays, which blurs into one
+	src := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			gray := uint8(0x60)
+			if (x+y)%2 == 0 {
+				gray = 0xa0
+			}
+			src.Set(x, y, color.RGBA{gray, gray, gray, 0xff})
+		}
+	}
+	c := newTestContext(t, 1, 1)
+	c.SetSrc(src)
+	c.SetMaxFontSize(10)
+	c.SetBackdropBlur(3)
+	box := Rectangle{X: 10, Y: 10, Width: 180, Height: 80}
+	img := mustWriteText(t, c, "i", box)
+
+	// the text is at the top left of the box, so the right of it is only blurred
+	backdrop := image.Rect(100, 10, 190, 90)
+	before, after := variance(src, backdrop), variance(img, backdrop)
+	if after >= before/10 {
+		t.Errorf("got a variance of %.1f inside of the box, want it well below %.1f", after, before)
+	}
+	outside := image.Rect(0, 0, 200, 10)
+	if before, after := variance(src, outside), variance(img, outside); after != before {
+		t.Errorf("got a variance of %.1f above the box, want it left at %.1f", after, before)
+	}
+}
+
+func TestTopAlignMode(t *testing.T) {
+	box := Rectangle{X: 10, Y: 20, Width: 280, Height: 160}
+	baselines := map[TopAlign]int32{}
+	tops := map[TopAlign]int{}
+	for _, mode := range []TopAlign{EmTop, AscentTop, CapHeightTop} {
+		c := newTestContext(t, 300, 200)
+		c.SetTopAlignMode(mode)
+		lines, fontSize, err := c.Layout("HH", box)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fontSize != 40 {
+			t.Fatalf("mode %d: got font size %d, want the text at the maximum size", mode, fontSize)
+		}
+		baselines[mode] = lines[0].YPos
+		img := mustWriteText(t, c, "HH", box)
+		tops[mode] = inkBounds(img, img.Bounds()).Min.Y
+	}
+
+	if !(baselines[CapHeightTop] < baselines[AscentTop]) || baselines[CapHeightTop] == baselines[EmTop] {
+		t.Errorf("got first baselines %v, want the cap height above the ascent and apart from the em", baselines)
+	}
+	// capital letters start at the top of the box when aligned by their height, and below it by the ascent
+	if top := tops[CapHeightTop]; top < int(box.Y)-1 || top > int(box.Y)+1 {
+		t.Errorf("the capitals start at %d aligned by cap height, want %d", top, box.Y)
+	}
+	if tops[AscentTop] <= int(box.Y)+1 {
+		t.Errorf("the capitals start at %d aligned by ascent, want them below the top of the box at %d", tops[AscentTop], box.Y)
+	}
+}
+
+func TestAnnotateBatch(t *testing.T) {
+	srcDir, outDir := tempDir(t), tempDir(t)
+	names := []string{"a.png", "b.png", "c.jpg", "d.jpeg", "e.png", "f.jpg"}
+	for i, name := range names {
+		var buf bytes.Buffer
+		img := filledImage(100+i, 60, color.White)
+		var err error
+		if filepath.Ext(name) == ".png" {
+			err = png.Encode(&buf, img)
+		} else {
+			err = jpeg.Encode(&buf, img, nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, srcDir, name, buf.Bytes())
+	}
+	writeFile(t, srcDir, "notes.txt", []byte("skipped"))
+	broken := writeFile(t, srcDir, "broken.png", []byte("not an image"))
+
+	c := newTestContext(t, 1, 1)
+	err := c.AnnotateBatch(srcDir, outDir, "Batch", Rectangle{X: 10, Y: 10, Width: 80, Height: 40})
+	failures, ok := err.(BatchError)
+	if !ok || len(failures) != 1 || failures[broken] == nil {
+		t.Fatalf("got %v, want only %s to fail", err, broken)
+	}
+
+	for i, name := range names {
+		file, err := os.Open(filepath.Join(outDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, _, err := image.Decode(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if img.Bounds().Dx() != 100+i || countInk(img, img.Bounds()) == 0 {
+			t.Errorf("%s: got a %v image without text, want the source annotated", name, img.Bounds())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "notes.txt")); !os.IsNotExist(err) {
+		t.Errorf("got %v for the file that isn't an image, want it skipped", err)
+	}
+}
+
+func TestSetGamma(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 180, Height: 40}
+	var imgs [2]image.Image
+	for i, gamma := range []float64{1, 2.2} {
+		c := newTestContext(t, 200, 60)
+		c.SetGamma(gamma)
+		imgs[i] = mustWriteText(t, c, "Gamma", box)
+	}
+
+	edges := 0
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 200; x++ {
+			plain, _, _, _ := imgs[0].At(x, y).RGBA()
+			heavier, _, _, _ := imgs[1].At(x, y).RGBA()
+			plain, heavier = plain>>8, heavier>>8
+			switch {
+			case plain == 0xff || plain == 0:
+				if heavier != plain {
+					t.Fatalf("pixel at %d,%d went from %#x to %#x, want pixels that are fully in or out unchanged", x, y, plain, heavier)
+				}
+			case plain > 0x20 && plain < 0xe0:
+				edges++
+				if heavier >= plain {
+					t.Fatalf("edge pixel at %d,%d went from %#x to %#x, want it darker", x, y, plain, heavier)
+				}
+			}
+		}
+	}
+	if edges == 0 {
+		t.Error("the text has no gray edge pixels")
+	}
+}
+
+func TestNegativeLetterSpacing(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 280, Height: 80}
+	const text = "condensed"
+	var widths []int32
+	for _, spacing := range []int32{0, -2, -1000} {
+		c := newTestContext(t, 300, 100)
+		c.SetMaxFontSize(20)
+		c.SetLetterSpacing(spacing)
+		widths = append(widths, c.runesWidth([]rune(text), 20))
+
+		boxes, err := c.GlyphBoxes(text, box)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i < len(boxes); i++ {
+			if boxes[i].Rect.Min.X <= boxes[i-1].Rect.Min.X {
+				t.Fatalf("spacing %d: %q starts at %d, after %q at %d, want the glyphs kept in order",
+					spacing, boxes[i].Rune, boxes[i].Rect.Min.X, boxes[i-1].Rune, boxes[i-1].Rect.Min.X)
+			}
+		}
+	}
+	if !(widths[1] < widths[0] && widths[2] < widths[1] && widths[2] > 0) {
+		t.Errorf("got widths %v, want them to shrink as the spacing does without reaching 0", widths)
+	}
+	// condensing by 2 pixels takes 2 pixels off of the advance of every glyph
+	if want := widths[0] - 2*int32(len(text)); widths[1] != want {
+		t.Errorf("got a width of %d condensed by 2, want %d", widths[1], want)
+	}
+}
+
+func TestPreviewBounds(t *testing.T) {
+	c := newTestContext(t, 300, 200)
+	box := Rectangle{X: 10, Y: 10, Width: 280, Height: 180}
+	text := "first line\nsecond\nthe third line"
+	preview := c.PreviewBounds(text, box)
+	if preview.Bounds() != image.Rect(0, 0, 300, 200) {
+		t.Fatalf("got a preview with bounds %v, want the source's", preview.Bounds())
+	}
+	lines, fontSize, err := c.Layout(text, box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3", len(lines))
+	}
+	for i, line := range lines {
+		// across the line, from its top to its baseline
+		for _, pt := range []image.Point{
+			{int(line.XPos + 1), int(line.YPos - 1)},
+			{int(line.XPos + line.currWidth - 1), int(line.YPos - int32(c.em(fontSize)) + 1)},
+		} {
+			if !isRed(preview.At(pt.X, pt.Y)) {
+				t.Errorf("line %d: pixel at %v is %v, want it filled", i, pt, preview.At(pt.X, pt.Y))
+			}
+		}
+		// past the end of the line
+		if end := line.XPos + line.currWidth + 1; isRed(preview.At(int(end), int(line.YPos-1))) {
+			t.Errorf("line %d: pixel past its end at %d is filled", i, end)
+		}
+	}
+}
+
+func TestFontFillPrecedence(t *testing.T) {
+	isBlue := func(col color.Color) bool {
+		r, g, b, _ := col.RGBA()
+		return b > 0xc000 && r < 0x8000 && g < 0x8000
+	}
+	redFill := filledImage(200, 60, color.RGBA{0xff, 0, 0, 0xff})
+	blue := Color{0, 0, 0xffff, 0xffff}
+	box := Rectangle{X: 10, Y: 10, Width: 180, Height: 40}
+	tests := []struct {
+		name string
+		set  func(c *Context)
+		want func(color.Color) bool
+	}{
+		{"image last", func(c *Context) { c.SetFontColor(blue); c.SetFontImage(redFill) }, isRed},
+		{"color last", func(c *Context) { c.SetFontImage(redFill); c.SetFontColor(blue) }, isBlue},
+	}
+	for _, test := range tests {
+		c := newTestContext(t, 200, 60)
+		c.SetAntialias(false)
+		test.set(c)
+		img := mustWriteText(t, c, "Filled", box)
+		drawn := 0
+		for y := 0; y < 60; y++ {
+			for x := 0; x < 200; x++ {
+				if col := img.At(x, y); isInk(col) {
+					drawn++
+					if !test.want(col) {
+						t.Fatalf("%s: pixel at %d,%d is %v", test.name, x, y, col)
+					}
+				}
+			}
+		}
+		if drawn == 0 {
+			t.Errorf("%s: no text was drawn", test.name)
+		}
+	}
+}
+
+func TestSetClipRect(t *testing.T) {
+	c := newTestContext(t, 200, 60)
+	c.SetTextBackground(Color{0, 0, 0xffff, 0xffff})
+	clip := image.Rect(50, 0, 120, 35)
+	c.SetClipRect(clip)
+	img := mustWriteText(t, c, "Clipped text", Rectangle{X: 10, Y: 10, Width: 180, Height: 40})
+
+	inside := 0
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 200; x++ {
+			if !image.Pt(x, y).In(clip) {
+				if got := color.RGBAModel.Convert(img.At(x, y)); got != (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+					t.Fatalf("pixel at %d,%d outside of the clip rect is %v, want it untouched", x, y, got)
+				}
+			} else if isInk(img.At(x, y)) {
+				inside++
+			}
+		}
+	}
+	if inside == 0 {
+		t.Error("nothing was drawn inside of the clip rect")
+	}
+}
+
+func TestSetMaxFontSizePx(t *testing.T) {
+	const px = 60
+	var heights []int
+	for _, dpi := range []float64{72, 144, DefaultDPI} {
+		c := newTestContext(t, 300, 200)
+		c.SetDPI(dpi)
+		c.SetMaxFontSizePx(px)
+		result, err := c.Render("H", Rectangle{X: 10, Y: 10, Width: 280, Height: 180})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.FitAtMax {
+			t.Fatalf("dpi %v: the text was shrunk, want it at the maximum size", dpi)
+		}
+		if em := c.em(result.FontSize); math.Abs(em-px) > 1 {
+			t.Errorf("dpi %v: got an em of %.1f pixels, want %d", dpi, em, px)
+		}
+		heights = append(heights, inkBounds(result.Image, result.Image.Bounds()).Dy())
+	}
+	for _, height := range heights {
+		// the cap height of Go Regular is about 0.7 em
+		if height < px*6/10 || height > px*8/10 || height-heights[0] > 1 || heights[0]-height > 1 {
+			t.Errorf("got capitals %v pixels high, want about %d at every DPI", heights, px*7/10)
+			break
+		}
+	}
+}
+
+func TestGlyphByGlyph(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 280, Height: 180}
+	text := "AVA Wave To kerned pairs, wrapped across a few lines of plain text"
+	for _, alignment := range []int{LEFT_ALIGNED, CENTERED, JUSTIFIED} {
+		var imgs [2]*image.RGBA
+		for i, glyphs := range []bool{false, true} {
+			c := newTestContext(t, 300, 200)
+			c.SetAlignment(alignment)
+			c.SetGlyphByGlyph(glyphs)
+			imgs[i] = mustWriteText(t, c, text, box).(*image.RGBA)
+		}
+		if !bytes.Equal(imgs[0].Pix, imgs[1].Pix) {
+			t.Errorf("alignment %d: drawing glyph by glyph changed the output", alignment)
+		}
+		if countInk(imgs[0], imgs[0].Bounds()) == 0 {
+			t.Errorf("alignment %d: no text was drawn", alignment)
+		}
+	}
+}
+
+func TestCombiningMarks(t *testing.T) {
+	c := newTestContext(t, 200, 100)
+	if base, combined := c.runesWidth([]rune("e"), 30), c.runesWidth([]rune("e\u0301"), 30); combined != base {
+		t.Errorf("got an advance of %d with the combining acute, want %d, the base's alone", combined, base)
+	}
+
+	box := Rectangle{X: 10, Y: 10, Width: 180, Height: 80}
+	var ends [2]int
+	var ink [2]int
+	for i, text := range []string{"Noe", "Noe\u0301"} {
+		c := newTestContext(t, 200, 100)
+		c.SetMaxFontSize(30)
+		result, err := c.Render(text, box)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ends[i] = result.LineEnds[0].X
+		ink[i] = countInk(result.Image, result.Image.Bounds())
+	}
+	if ends[1] != ends[0] {
+		t.Errorf("the line with the mark ends at %d, want %d, where it ends without", ends[1], ends[0])
+	}
+	if ink[1] <= ink[0] {
+		t.Error("the combining mark wasn't drawn")
+	}
+}
+
+func TestSetOpacity(t *testing.T) {
+	c := newTestContext(t, 200, 60)
+	c.SetAntialias(false)
+	c.SetFontColor(Color{0, 0, 0xffff, 0xffff})
+	c.SetOpacity(0.5)
+	img := mustWriteText(t, c, "Opacity", Rectangle{X: 10, Y: 10, Width: 180, Height: 40})
+
+	// halfway between the white source and the blue text
+	glyphs := 0
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 200; x++ {
+			got := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			if got == (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+				continue
+			}
+			glyphs++
+			if got.B != 0xff || got.A != 0xff || got.R < 0x7e || got.R > 0x81 || got.G != got.R {
+				t.Fatalf("glyph pixel at %d,%d is %v, want it halfway between white and blue", x, y, got)
+			}
+		}
+	}
+	if glyphs == 0 {
+		t.Error("no text was drawn")
+	}
+}
+
+func TestSupportedFormats(t *testing.T) {
+	formats := SupportedFormats()
+	for _, want := range []string{"png", "jpeg"} {
+		found := false
+		for _, name := range formats {
+			found = found || name == want
+		}
+		if !found {
+			t.Errorf("got formats %q, want %q among them", formats, want)
+		}
+	}
+
+	// every format round trips through an Encoder and the decoders registered with image
+	for _, name := range formats {
+		encoder, err := NewEncoder(filledImage(10, 10, color.White), name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var buf bytes.Buffer
+		if _, err := encoder.WriteTo(&buf); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, decoded, err := image.Decode(&buf); err != nil || decoded != name {
+			t.Errorf("%s: decoded as %q with error %v", name, decoded, err)
+		}
+	}
+
+	// a newly added format is listed
+	defer func(formats []imageFormat) { imageFormats = formats }(imageFormats)
+	imageFormats = append(imageFormats[:len(imageFormats):len(imageFormats)], imageFormat{name: "gif", extensions: []string{".gif"}})
+	if got := SupportedFormats(); got[len(got)-1] != "gif" || len(got) != len(formats)+1 {
+		t.Errorf("got formats %q after adding gif, want it listed", got)
+	}
+}
+
+func TestSetFontImageInterpolation(t *testing.T) {
+	// a 2x2 checkerboard, upscaled to the whole source
+	pattern := filledImage(2, 2, color.White)
+	pattern.Set(0, 0, color.Black)
+	pattern.Set(1, 1, color.Black)
+
+	var fills [2]*image.RGBA
+	for i, interpolator := range []xdraw.Interpolator{xdraw.NearestNeighbor, xdraw.CatmullRom} {
+		c := newTestContext(t, 100, 100)
+		c.SetFontImageMode(Stretch)
+		c.SetFontImageInterpolation(interpolator)
+		c.SetFontImage(pattern)
+		fills[i] = c.fontBackground.(*image.RGBA)
+	}
+
+	grays := [2]int{}
+	for i, fill := range fills {
+		for p := 0; p < len(fill.Pix); p += 4 {
+			if v := fill.Pix[p]; v != 0 && v != 0xff {
+				grays[i]++
+			}
+		}
+	}
+	if grays[0] != 0 || grays[1] == 0 {
+		t.Errorf("got %d gray pixels with nearest neighbor and %d with Catmull-Rom, want none and some", grays[0], grays[1])
+	}
+	if bytes.Equal(fills[0].Pix, fills[1].Pix) {
+		t.Error("both interpolators filled the text the same")
+	}
+}
+
+func TestLayout(t *testing.T) {
+	box := Rectangle{X: 20, Y: 10, Width: 260, Height: 180}
+	text := "lines laid out by Layout can be inspected without drawing anything\nshort"
+	for _, alignment := range []int{LEFT_ALIGNED, CENTERED} {
+		c := newTestContext(t, 300, 200)
+		c.SetAlignment(alignment)
+		lines, fontSize, err := c.Layout(text, box)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) < 3 {
+			t.Fatalf("alignment %d: got %d lines, want the first sentence wrapped", alignment, len(lines))
+		}
+
+		for i, line := range lines {
+			if want := c.runesWidth([]rune(strings.Join(line.Words, " ")), fontSize); line.Width() != want {
+				t.Errorf("alignment %d: line %d is %d wide, want %d", alignment, i, line.Width(), want)
+			}
+			if line.Width() > box.Width {
+				t.Errorf("alignment %d: line %d is %d wide, wider than the box", alignment, i, line.Width())
+			}
+			switch alignment {
+			case LEFT_ALIGNED:
+				if line.XPos != box.X {
+					t.Errorf("alignment %d: line %d starts at %d, want %d", alignment, i, line.XPos, box.X)
+				}
+			case CENTERED:
+				left, right := line.XPos-box.X, box.X+box.Width-(line.XPos+line.currWidth)
+				if left-right > 1 || right-left > 1 {
+					t.Errorf("alignment %d: line %d has %d pixels to its left and %d to its right", alignment, i, left, right)
+				}
+			}
+			if i > 0 && line.YPos-lines[i-1].YPos != line.BaseToBaseHeight {
+				t.Errorf("alignment %d: line %d is %d below the one above, want its BaseToBaseHeight %d",
+					alignment, i, line.YPos-lines[i-1].YPos, line.BaseToBaseHeight)
+			}
+		}
+		if lines[0].YPos != box.Y+lines[0].BaseToBaseHeight {
+			t.Errorf("alignment %d: the first baseline is at %d, want %d below the top of the box",
+				alignment, lines[0].YPos, lines[0].BaseToBaseHeight)
+		}
+		if last := lines[len(lines)-1]; !last.ParagraphEnd || !lines[len(lines)-2].ParagraphEnd || lines[0].ParagraphEnd {
+			t.Errorf("alignment %d: want the lines before the newline and at the end to end paragraphs", alignment)
+		}
+	}
+}
+
+func TestWriteList(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 200, Height: 180}
+	items := []string{"the first item is long enough to wrap onto more lines", "second"}
+	for _, marker := range []ListMarker{DiscMarker, DecimalMarker, CustomMarker("->")} {
+		c := newTestContext(t, 220, 200)
+		const fontSize = 14
+		lines, fits := c.layoutList(items, box, marker, fontSize)
+		if !fits {
+			t.Fatalf("marker %q: the list doesn't fit", marker.text)
+		}
+		textLines, markers := lines[:len(lines)-len(items)], lines[len(lines)-len(items):]
+		if len(textLines) < len(items)+1 {
+			t.Fatalf("marker %q: got %d lines of text, want the first item wrapped", marker.text, len(textLines))
+		}
+		markerWidth := int32(0)
+		for _, m := range markers {
+			if m.XPos != box.X {
+				t.Errorf("marker %q: a marker starts at %d, want the left of the box", marker.text, m.XPos)
+			}
+			markerWidth = larger(markerWidth, m.Width())
+		}
+		// continuation lines hang under the text of their item, not under the marker
+		for i, line := range textLines {
+			if line.XPos != textLines[0].XPos || line.XPos <= box.X+markerWidth {
+				t.Errorf("marker %q: line %d starts at %d, want it past the %d pixel marker at %d",
+					marker.text, i, line.XPos, markerWidth, textLines[0].XPos)
+			}
+		}
+
+		img, err := c.WriteList(items, box, marker)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gutter := image.Rect(int(box.X), int(box.Y), int(textLines[0].XPos)-1, int(box.Y+box.Height)); countInk(img, gutter) == 0 {
+			t.Errorf("marker %q: no marker was drawn", marker.text)
+		}
+	}
+}
+
+func TestFontCache(t *testing.T) {
+	var reads int32
+	defer func(read func(string) ([]byte, error)) { readFontFile = read }(readFontFile)
+	readFontFile = func(path string) ([]byte, error) {
+		atomic.AddInt32(&reads, 1)
+		return ioutil.ReadFile(path)
+	}
+	ClearFontCache()
+	defer ClearFontCache()
+	path := writeFile(t, tempDir(t), "font.ttf", goregular.TTF)
+
+	first, second := NewContext(), NewContext()
+	if err := first.SetFontPath(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.SetFontPath(path); err != nil {
+		t.Fatal(err)
+	}
+	if reads != 1 || first.font != second.font {
+		t.Fatalf("got %d reads and the same font %v, want the second load served from the cache", reads, first.font == second.font)
+	}
+
+	ClearFontCache()
+	if err := second.SetFontPath(path); err != nil {
+		t.Fatal(err)
+	}
+	if reads != 2 {
+		t.Errorf("got %d reads, want the file read again after clearing the cache", reads)
+	}
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.SetFontPath(path); err != nil {
+		t.Fatal(err)
+	}
+	if reads != 3 {
+		t.Errorf("got %d reads, want the modified file read again", reads)
+	}
+
+	// concurrent loads of a cached font don't read it again
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := NewContext().SetFontPath(path); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := atomic.LoadInt32(&reads); got != 3 {
+		t.Errorf("got %d reads after loading the font concurrently, want 3", got)
+	}
+}
+
+func TestSetOriginMode(t *testing.T) {
+	const x, y, fontSize = 20, 100, 30
+	var ink [2]image.Rectangle
+	var ascent int32
+	for i, mode := range []OriginMode{OriginBaseline, OriginTopLeft} {
+		c := newTestContext(t, 300, 200)
+		c.SetOriginMode(mode)
+		img, err := c.WriteLine("Hbx", x, y, fontSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ink[i] = inkBounds(img, img.Bounds())
+		ascent = c.bounds(fontSize).YMax
+	}
+
+	// the glyphs sit on the baseline by default
+	if bottom := ink[0].Max.Y; bottom < y-1 || bottom > y+1 {
+		t.Errorf("glyphs end at %d from the baseline, want %d", bottom, y)
+	}
+	// and hang below the ascent from the top-left
+	if top := ink[1].Min.Y; top < y {
+		t.Errorf("glyphs start at %d from the top-left, want them below %d", top, y)
+	}
+	if shift := int32(ink[1].Min.Y - ink[0].Min.Y); shift != ascent {
+		t.Errorf("the modes are %d pixels apart, want the ascent of %d", shift, ascent)
+	}
+	if ink[0].Min.X != ink[1].Min.X {
+		t.Errorf("glyphs start at %d and %d across, want the same", ink[0].Min.X, ink[1].Min.X)
+	}
+}
+
+func TestSixteenBitSource(t *testing.T) {
+	const value = 0x1234 // not representable in 8 bits
+	src := image.NewRGBA64(image.Rect(0, 0, 200, 60))
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 200; x++ {
+			src.SetRGBA64(x, y, color.RGBA64{value, value, value, 0xffff})
+		}
+	}
+	c := newTestContext(t, 1, 1)
+	c.SetSrc(src)
+	c.SetFontColor(Color{0xffff, 0xffff, 0xffff, 0xffff})
+
+	var buf bytes.Buffer
+	if err := c.WriteTextTo(&buf, "png", "Deep", Rectangle{X: 10, Y: 10, Width: 180, Height: 40}); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _, _, _ := img.At(2, 2).RGBA(); r != value {
+		t.Errorf("an untouched pixel is %#x after annotating, want %#x", r, value)
+	}
+	if countInk(img, img.Bounds()) == img.Bounds().Dx()*img.Bounds().Dy() {
+		t.Error("no text was drawn")
+	}
+}
+
+func TestLineEnds(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 280, Height: 180}
+	text := "Label: value with a trailing icon\nand a second paragraph"
+	for _, alignment := range []int{LEFT_ALIGNED, CENTERED} {
+		for _, spacing := range []int32{0, 2} {
+			c := newTestContext(t, 300, 200)
+			c.SetAlignment(alignment)
+			c.SetLetterSpacing(spacing)
+			lines, _, err := c.Layout(text, box)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := c.Render(text, box)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.LineEnds) != len(lines) {
+				t.Fatalf("got %d line ends for %d lines", len(result.LineEnds), len(lines))
+			}
+			for i, line := range lines {
+				want := image.Pt(int(line.XPos+line.Width()), int(line.YPos))
+				if got := result.LineEnds[i]; got != want {
+					t.Errorf("alignment %d, spacing %d: line %d ends at %v, want %v", alignment, spacing, i, got, want)
+				}
+			}
+		}
+	}
+}
+
+// allocatedBytes returns the number of bytes allocated on the heap while running fn
+func allocatedBytes(fn func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestWriteTextOntoAliasing(t *testing.T) {
+	const width, height = 1000, 1000
+	box := Rectangle{X: 100, Y: 100, Width: 400, Height: 100}
+	var allocated [2]uint64
+	for i, inPlace := range []bool{false, true} {
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{color.White, color.Black})
+		c := newTestContext(t, 1, 1)
+		c.SetInPlace(inPlace)
+		// the first frame warms up the glyph and scratch buffer caches
+		if err := c.WriteTextOnto(frame, "Frame", box); err != nil {
+			t.Fatal(err)
+		}
+		allocated[i] = allocatedBytes(func() {
+			if err := c.WriteTextOnto(frame, "Frame", box); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	// drawing in place neither copies the frame nor allocates anything the size of it
+	if allocated[0] < width*height || allocated[1] >= width*height/4 {
+		t.Errorf("got %d bytes allocated copying the frame and %d in place, want the frame's size only when copying", allocated[0], allocated[1])
+	}
+}
+
+func BenchmarkWriteTextOnto(b *testing.B) {
+	for _, inPlace := range []bool{false, true} {
+		name := "copy"
+		if inPlace {
+			name = "in-place"
+		}
+		b.Run(name, func(b *testing.B) {
+			frame := image.NewPaletted(image.Rect(0, 0, 1920, 1080), color.Palette{color.White, color.Black})
+			c := newTestContext(b, 1, 1)
+			c.SetInPlace(inPlace)
+			box := Rectangle{X: 100, Y: 100, Width: 800, Height: 200}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.WriteTextOnto(frame, "Benchmark", box); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSetFontSizeTolerance(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 280, Height: 60}
+	text := "Some text that has to be shrunk to fit"
+	var results []*Result
+	for _, tolerance := range []int32{1, 16} {
+		c := newTestContext(t, 300, 200)
+		c.SetMaxFontSize(500)
+		c.SetFontSizeTolerance(tolerance)
+		result, err := c.Render(text, box)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, result)
+	}
+	exact, rough := results[0], results[1]
+	if rough.Iterations >= exact.Iterations {
+		t.Errorf("took %d iterations with a tolerance of 16 and %d with 1, want fewer", rough.Iterations, exact.Iterations)
+	}
+	if rough.FontSize > exact.FontSize || exact.FontSize-rough.FontSize > 16 {
+		t.Errorf("got size %d with a tolerance of 16, want it within 16 below %d", rough.FontSize, exact.FontSize)
+	}
+}
+
+func TestSetFlip(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 280, Height: 60}
+	var imgs [2]image.Image
+	var first image.Rectangle
+	for i, flip := range []bool{false, true} {
+		c := newTestContext(t, 300, 80)
+		c.SetMaxFontSize(30)
+		c.SetFlip(flip, false)
+		boxes, err := c.GlyphBoxes("Flip", box)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first = boxes[0].Rect
+		imgs[i] = mustWriteText(t, c, "Flip", box)
+	}
+
+	// the text is mirrored within the bounding box
+	r := box.Rect()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			mirrored := r.Min.X + r.Max.X - 1 - x
+			if want, got := imgs[0].At(x, y), imgs[1].At(mirrored, y); got != want {
+				t.Fatalf("flipped pixel at %d,%d is %v, want %v from %d,%d", mirrored, y, got, want, x, y)
+			}
+		}
+	}
+	// so the first glyph ends up on the right
+	flippedFirst := image.Rect(r.Min.X+r.Max.X-first.Max.X, first.Min.Y, r.Min.X+r.Max.X-first.Min.X, first.Max.Y)
+	if flippedFirst.Min.X < r.Min.X+r.Dx()/2 || countInk(imgs[1], flippedFirst) == 0 {
+		t.Errorf("nothing was drawn at %v, where the first glyph at %v is mirrored to", flippedFirst, first)
+	}
+}
+
+func TestSetFontColorAutoContrast(t *testing.T) {
+	light, dark := Color{0xffff, 0xffff, 0xffff, 0xffff}, Color{0, 0, 0, 0xffff}
+	box := Rectangle{X: 10, Y: 10, Width: 180, Height: 40}
+	tests := []struct {
+		name       string
+		background color.Color
+		want       Color
+	}{
+		{"dark image", color.RGBA{0x20, 0x20, 0x30, 0xff}, light},
+		{"light image", color.RGBA{0xe0, 0xe0, 0xd0, 0xff}, dark},
+	}
+	for _, test := range tests {
+		c := newTestContext(t, 1, 1)
+		c.SetSrc(filledImage(200, 60, test.background))
+		c.SetAntialias(false)
+		c.SetFontColorAutoContrast(light, dark)
+		if got := c.contrastColor(box.Rect()); got != test.want {
+			t.Errorf("%s: chose %v, want %v", test.name, got, test.want)
+		}
+
+		img := mustWriteText(t, c, "Contrast", box)
+		drawn := 0
+		for y := 0; y < 60; y++ {
+			for x := 0; x < 200; x++ {
+				if got := img.At(x, y); color.RGBAModel.Convert(got) != color.RGBAModel.Convert(test.background) {
+					drawn++
+					if color.RGBAModel.Convert(got) != color.RGBAModel.Convert(test.want) {
+						t.Fatalf("%s: text pixel at %d,%d is %v, want %v", test.name, x, y, got, test.want)
+					}
+				}
+			}
+		}
+		if drawn == 0 {
+			t.Errorf("%s: no text was drawn", test.name)
+		}
+	}
+}
+
+func TestRenderMask(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 180, Height: 40}
+	// small enough that no glyph hangs out of the box, which the mask doesn't cover
+	c := newTestContext(t, 200, 60)
+	c.SetMaxFontSize(20)
+	mask, err := c.RenderMask("Masked", box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mask.Bounds() != box.Rect() {
+		t.Fatalf("got a mask with bounds %v, want the bounding box %v", mask.Bounds(), box.Rect())
+	}
+
+	// black text on white has the mask's coverage as its darkness
+	c = newTestContext(t, 200, 60)
+	c.SetMaxFontSize(20)
+	img := mustWriteText(t, c, "Masked", box)
+	covered := 0
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 200; x++ {
+			r, _, _, _ := img.At(x, y).RGBA()
+			darkness := 0xff - int(r>>8)
+			coverage := int(mask.AlphaAt(x, y).A)
+			if coverage > 0 {
+				covered++
+			}
+			if (coverage == 0) != (darkness == 0) || coverage-darkness > 1 || darkness-coverage > 1 {
+				t.Fatalf("pixel at %d,%d has a coverage of %d in the mask and %d when drawn", x, y, coverage, darkness)
+			}
+		}
+	}
+	if covered == 0 {
+		t.Error("the mask is empty")
+	}
+	if _, err := NewContext().RenderMask("Masked", box); err != ErrNoFont {
+		t.Errorf("got %v without a font, want ErrNoFont", err)
+	}
+}
+
+func TestSetLineWidthFunc(t *testing.T) {
+	c := newTestContext(t, 300, 400)
+	box := Rectangle{X: 10, Y: 10, Width: 280, Height: 380}
+	c.SetLineWidthFunc(func(i int) int32 {
+		if i%2 == 1 {
+			return box.Width / 2
+		}
+		return box.Width
+	})
+	lines := c.createTextLines(strings.Repeat("word ", 60), box, 14)
+	if len(lines) < 5 {
+		t.Fatalf("got %d lines, want the text wrapped", len(lines))
+	}
+	// the last line holds whatever is left
+	for i, line := range lines[:len(lines)-1] {
+		if line.currWidth > c.lineWidth(i, box) {
+			t.Errorf("line %d is %d wide, wider than its %d", i, line.currWidth, c.lineWidth(i, box))
+		}
+		if i%2 == 1 && len(line.Words) >= len(lines[i-1].Words) {
+			t.Errorf("line %d has %d words after %d, want fewer on the narrow lines", i, len(line.Words), len(lines[i-1].Words))
+		}
+	}
+}
+
+func TestCJKBreaking(t *testing.T) {
+	text := "これは画像に文字を書き込むためのAnnotateという長い日本語の文章です。行は文字の間で折り返されます。"
+	box := Rectangle{X: 0, Y: 0, Width: 120, Height: 400}
+	c := newTestContext(t, 200, 400)
+	if got := c.WrapText(text, box, 12); len(got) != 1 {
+		t.Fatalf("got %d lines without CJK breaking, want the run kept whole", len(got))
+	}
+
+	c.SetCJKBreaking(true)
+	lines := c.createTextLines(text, box, 12)
+	if len(lines) < 3 {
+		t.Fatalf("got %d lines, want the sentence wrapped", len(lines))
+	}
+	joined, whole := "", 0
+	for i, line := range lines {
+		lineText := strings.Join(line.Words, "")
+		joined += lineText
+		if line.currWidth > box.Width {
+			t.Errorf("line %d %q is %d wide, wider than the box", i, lineText, line.currWidth)
+		}
+		if first, _ := utf8.DecodeRuneInString(lineText); unicode.IsPunct(first) {
+			t.Errorf("line %d %q starts with punctuation", i, lineText)
+		}
+		if strings.Contains(lineText, "Annotate") {
+			whole++
+		}
+	}
+	if whole != 1 {
+		t.Error("the Latin word was broken across lines")
+	}
+	if joined != text {
+		t.Errorf("the lines put back together are %q, want %q", joined, text)
+	}
+}
+
+func TestWriteTextWithSpans(t *testing.T) {
+	c := newTestContext(t, 300, 300)
+	c.SetMaxFontSize(20)
+	text := "visit example site today"
+	// narrow enough to put every word on a line of its own
+	box := Rectangle{X: 10, Y: 10, Width: 40, Height: 280}
+	link := Span{Start: strings.Index(text, "example"), End: strings.Index(text, " today"), Data: "https://example.com"}
+	img, resolved, err := c.WriteTextWithSpans(text, box, []Span{link})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resolved) != 1 || resolved[0].Data != link.Data {
+		t.Fatalf("got %+v, want the span resolved with its data", resolved)
+	}
+	rects := resolved[0].Rects
+	if len(rects) != 2 {
+		t.Fatalf("got rectangles %v, want one for each of the two lines the span is on", rects)
+	}
+	if rects[0].Min.Y >= rects[1].Min.Y || rects[0].Min.X != rects[1].Min.X {
+		t.Errorf("got rectangles %v, want the second below the first, both starting at the left", rects)
+	}
+	for i, r := range rects {
+		if countInk(img, r) == 0 {
+			t.Errorf("nothing was drawn in rectangle %d %v", i, r)
+		}
+	}
+	// "example" is wider than "site"
+	if rects[0].Dx() <= rects[1].Dx() {
+		t.Errorf("got rectangles %v, want each as wide as its word", rects)
+	}
+}
+
+func TestSetDPIChecked(t *testing.T) {
+	for _, dpi := range []float64{0, -72, math.NaN()} {
+		c := newTestContext(t, 200, 60)
+		if err := c.SetDPIChecked(dpi); err != ErrInvalidDPI {
+			t.Errorf("dpi %v: got %v, want ErrInvalidDPI", dpi, err)
+		}
+		// SetDPI ignores it, so text is still drawn at the default DPI
+		c.SetDPI(dpi)
+		if c.dpi != DefaultDPI {
+			t.Errorf("dpi %v: the DPI changed to %v, want it left at the default", dpi, c.dpi)
+		}
+		img := mustWriteText(t, c, "Visible", Rectangle{X: 10, Y: 10, Width: 180, Height: 40})
+		if countInk(img, img.Bounds()) == 0 {
+			t.Errorf("dpi %v: no text was drawn", dpi)
+		}
+	}
+	c := NewContext()
+	if err := c.SetDPIChecked(144); err != nil || c.dpi != 144 {
+		t.Errorf("got %v and a DPI of %v, want 144 accepted", err, c.dpi)
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	c := newTestContext(t, 200, 60)
+	img := mustWriteText(t, c, "Streamed", Rectangle{X: 10, Y: 10, Width: 180, Height: 40}).(*image.RGBA)
+
+	encoder, err := NewEncoder(img, "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	n, err := encoder.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("reported %d bytes written, want %d", n, buf.Len())
+	}
+	decoded, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rgba := image.NewRGBA(decoded.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), decoded, image.ZP, draw.Src)
+	if rgba.Bounds() != img.Bounds() || !bytes.Equal(rgba.Pix, img.Pix) {
+		t.Error("the decoded image differs from the one that was encoded")
+	}
+
+	var unsupported UnsupportedError
+	if _, err := NewEncoder(img, "bmp"); !errors.As(err, &unsupported) {
+		t.Errorf("got %v for an unknown format, want an UnsupportedError", err)
+	}
+}
+
+func BenchmarkEncoder(b *testing.B) {
+	img := filledImage(4000, 3000, color.White)
+	for y := 0; y < 3000; y += 7 {
+		for x := 0; x < 4000; x += 5 {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 0, 0xff})
+		}
+	}
+	b.Run("in-memory", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, img); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := buf.WriteTo(ioutil.Discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("streaming", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			encoder, err := NewEncoder(img, "png")
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := encoder.WriteTo(ioutil.Discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestNegativeBoxOrigin(t *testing.T) {
+	const shift = 100
+	box := Rectangle{X: -50, Y: 10, Width: 200, Height: 40}
+	c := newTestContext(t, 200, 60)
+	img := mustWriteText(t, c, "Off canvas", box)
+
+	// the same text drawn fully on a wider canvas
+	shifted := box
+	shifted.X += shift
+	whole := mustWriteText(t, newTestContext(t, 200+shift, 60), "Off canvas", shifted)
+
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 200; x++ {
+			if got, want := img.At(x, y), whole.At(x+shift, y); got != want {
+				t.Fatalf("pixel at %d,%d is %v, want %v as drawn fully on canvas", x, y, got, want)
+			}
+		}
+	}
+	// some of the text is cut off, and the rest is drawn
+	if countInk(whole, image.Rect(shift-50, 0, shift, 60)) == 0 || countInk(img, img.Bounds()) == 0 {
+		t.Error("want text both off and on the canvas")
+	}
+}
+
+func TestDrawImageAt(t *testing.T) {
+	c := newTestContext(t, 100, 60)
+	// an overlay whose bounds don't start at the origin, hanging off the right of the source
+	overlay := image.NewRGBA(image.Rect(5, 5, 35, 25))
+	draw.Draw(overlay, overlay.Bounds(), image.NewUniform(color.RGBA{0, 0, 0xff, 0xff}), image.ZP, draw.Src)
+	img, err := c.DrawImageAt(overlay, 80, 10, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 100; x++ {
+			got := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			if !image.Pt(x, y).In(image.Rect(80, 10, 100, 30)) {
+				if got != (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+					t.Fatalf("pixel at %d,%d outside of the overlay is %v, want it untouched", x, y, got)
+				}
+				continue
+			}
+			// halfway between the white source and the blue overlay
+			if got.B != 0xff || got.R < 0x7e || got.R > 0x81 || got.G != got.R {
+				t.Fatalf("pixel at %d,%d is %v, want the overlay blended at half opacity", x, y, got)
+			}
+		}
+	}
+	if c.src != img {
+		t.Error("the result didn't become the source for the next annotation")
+	}
+}
+
+func TestWriteRichText(t *testing.T) {
+	bold, err := freetype.ParseFont(gobold.TTF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	red := Color{0xffff, 0, 0, 0xffff}
+	runs := []TextRun{
+		{Text: "Bold start ", Font: bold, Color: &red},
+		{Text: "then regular words that wrap onto another line"},
+	}
+	box := Rectangle{X: 10, Y: 10, Width: 280, Height: 80}
+	c := newTestContext(t, 300, 100)
+	c.SetMaxFontSize(16)
+
+	runContexts := []*Context{c.Clone(), c}
+	runContexts[0].font = bold
+	lines, _ := c.layoutRichText(runs, runContexts, splitRichText(runs), box, 16)
+	if len(lines) < 2 {
+		t.Fatalf("got %d lines, want the text wrapped", len(lines))
+	}
+	first := lines[0]
+	if first.pieces[0].run != 0 || first.pieces[len(first.pieces)-1].run != 1 {
+		t.Fatalf("got pieces %+v on the first line, want both runs", first.pieces)
+	}
+	// the regular run starts after the bold one, measured with the bold font
+	boldWidth := runContexts[0].runesWidth([]rune("Bold start "), 16)
+	if regularWidth := c.runesWidth([]rune("Bold start "), 16); boldWidth <= regularWidth {
+		t.Fatalf("the bold text is %d wide and the regular %d, want bold wider", boldWidth, regularWidth)
+	}
+	for _, piece := range first.pieces {
+		if piece.run == 1 {
+			if piece.x != boldWidth {
+				t.Errorf("the regular run starts at %d, want %d after the bold run", piece.x, boldWidth)
+			}
+			break
+		}
+	}
+
+	img, err := c.WriteRichText(runs, box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the bold run is drawn in red at the left of the first line and the regular run in black after it
+	band := image.Rect(int(box.X), int(box.Y), int(box.X+box.Width), int(first.y))
+	redEnd, blackStart := 0, int(box.X+box.Width)
+	for y := band.Min.Y; y < band.Max.Y; y++ {
+		for x := band.Min.X; x < band.Max.X; x++ {
+			col := img.At(x, y)
+			if isRed(col) && x > redEnd {
+				redEnd = x
+			} else if r, g, b, _ := col.RGBA(); r < 0x4000 && g < 0x4000 && b < 0x4000 && x < blackStart {
+				blackStart = x
+			}
+		}
+	}
+	if redEnd == 0 || redEnd >= blackStart {
+		t.Errorf("red text ends at %d and black text starts at %d, want the bold run first", redEnd, blackStart)
+	}
+}
+
+func TestBlankLines(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 180, Height: 180}
+	c := newTestContext(t, 200, 200)
+	c.SetMaxFontSize(20)
+	c.SetParagraphSpacing(0.5)
+	lines, fontSize, err := c.Layout("a\n\nb", box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 3 || !lines[1].Blank() {
+		t.Fatalf("got %d lines, want a blank line between a and b", len(lines))
+	}
+	advance := c.lineAdvance(fontSize)
+	// the paragraph gap is added once, after a, and not again after the blank line
+	gap := int32(0.5 * c.em(fontSize))
+	if got := lines[1].YPos - lines[0].YPos; got != advance+gap {
+		t.Errorf("the blank line is %d below a, want %d", got, advance+gap)
+	}
+	if got := lines[2].YPos - lines[1].YPos; got != advance {
+		t.Errorf("b is %d below the blank line, want a full line of %d", got, advance)
+	}
+
+	img := mustWriteText(t, c, "a\n\nb", box)
+	// nothing is drawn between the baseline of a and the top of b
+	bTop := int(lines[2].YPos - c.bounds(fontSize).YMax)
+	if band := image.Rect(0, int(lines[0].YPos)+1, 200, bTop); band.Dy() < int(advance) || countInk(img, band) != 0 {
+		t.Errorf("got ink in the %d pixels between a and b, want a visible empty line", band.Dy())
+	}
+}
+
+func TestSetLeading(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 280, Height: 380}
+	for _, leading := range []int32{0, 7, 20} {
+		c := newTestContext(t, 300, 400)
+		c.SetMaxFontSize(20)
+		c.SetLeading(leading)
+		lines, fontSize, err := c.Layout("first\nsecond\nthird", box)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bounds := c.bounds(fontSize)
+		natural := bounds.YMax - bounds.YMin
+		for i := 1; i < len(lines); i++ {
+			if got := lines[i].YPos - lines[i-1].YPos; got != natural+leading {
+				t.Errorf("leading %d: line %d is %d below the one above, want %d plus %d", leading, i, got, natural, leading)
+			}
+		}
+	}
+
+	// whichever of SetLineHeight and SetLeading was called last wins
+	c := newTestContext(t, 300, 400)
+	c.SetLeading(20)
+	c.SetLineHeight(0)
+	if got, want := c.lineAdvance(20), int32(c.em(20)); got != want {
+		t.Errorf("got a line advance of %d after SetLineHeight, want %d", got, want)
+	}
+}
+
+func TestWriteMetric(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 180, Height: 60}
+	c := newTestContext(t, 200, 80)
+	img, err := c.WriteMetric(1234567, "", box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact := inkBounds(img, img.Bounds())
+
+	// the full number has to shrink to fit on one line
+	full := newTestContext(t, 200, 80)
+	full.SetWrap(false)
+	result, err := full.Render("1,234,567", box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shrunk := inkBounds(result.Image, result.Image.Bounds())
+
+	if !compact.In(box.Rect().Inset(-2)) {
+		t.Errorf("the metric was drawn over %v, want it inside of the box", compact)
+	}
+	// digits are about 0.7 em high at the max size
+	if min := int(0.6 * c.em(40)); compact.Dy() < min || compact.Dy() <= shrunk.Dy() {
+		t.Errorf("got digits %d pixels high, want at least %d and more than the %d of the full number",
+			compact.Dy(), min, shrunk.Dy())
+	}
+
+	candidates := metricCandidates(1234567)
+	want := []string{"1,234,567", "1.23M", "1.2M", "1M"}
+	if !reflect.DeepEqual(candidates, want) {
+		t.Errorf("got candidates %q, want %q", candidates, want)
+	}
+}
+
+func TestSetDeterministic(t *testing.T) {
+	render := func() []byte {
+		c := newTestContext(t, 200, 100)
+		c.SetDeterministic(true)
+		c.SetSubPixel(true)
+		c.SetDPI(81.58)
+		img := mustWriteText(t, c, "Golden image", Rectangle{X: 7, Y: 3, Width: 185, Height: 90})
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	first, second := render(), render()
+	if !bytes.Equal(first, second) {
+		t.Error("rendering the same input twice gave different images, want them byte for byte the same")
+	}
+
+	c := NewContext()
+	c.SetDeterministic(true)
+	if dpi := c.pinDPI(81.58); dpi != 82 {
+		t.Errorf("got DPI %v in deterministic mode, want 82", dpi)
+	}
+}
+
+func TestSetSmartTypography(t *testing.T) {
+	c := newTestContext(t, 300, 100)
+	c.SetMaxFontSize(20)
+	c.SetSmartTypography(true)
+	boxes, err := c.GlyphBoxes(`"quoted" -- it's done...`, Rectangle{X: 10, Y: 10, Width: 280, Height: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runes := make([]rune, len(boxes))
+	for i, box := range boxes {
+		runes[i] = box.Rune
+	}
+	if got, want := string(runes), "\u201cquoted\u201d \u2014 it\u2019s done\u2026"; got != want {
+		t.Fatalf("laid out %q, want %q", got, want)
+	}
+
+	font := testFont(t)
+	straight := font.Index('"')
+	for _, r := range []rune{runes[0], runes[7]} {
+		if index := font.Index(r); index == 0 || index == straight {
+			t.Errorf("%U is drawn with glyph %d, want a curly quote glyph other than the straight quote's %d", r, index, straight)
+		}
+	}
+
+	if got := smarten(`say "hi" (or 'bye')`); got != "say \u201chi\u201d (or \u2018bye\u2019)" {
+		t.Errorf("got %q, want the quotes to open and close", got)
+	}
+}
+
+func TestSetMaxPixels(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 180, Height: 80}
+	c := newTestContext(t, 200, 100)
+	c.SetMaxPixels(200*100 - 1)
+	if err, img := c.WriteText("Too big", box); err != ErrTooManyPixels || img != nil {
+		t.Errorf("got error %v and image %v for an oversized source, want ErrTooManyPixels", err, img)
+	}
+
+	c.SetMaxPixels(200 * 100)
+	mustWriteText(t, c, "Just right", box)
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, filledImage(200, 100, color.White)); err != nil {
+		t.Fatal(err)
+	}
+	path := writeFile(t, tempDir(t), "large.png", encoded.Bytes())
+	c.SetMaxPixels(1000)
+	if err := c.SetSrcPath(path); err != ErrTooManyPixels {
+		t.Errorf("got error %v loading an oversized source, want ErrTooManyPixels", err)
+	}
+}
+
+func TestSetSupersampleFilter(t *testing.T) {
+	// a supersampled edge running diagonally across the mask
+	const factor = 4
+	mask := image.NewAlpha(image.Rect(0, 0, 16*factor, 16*factor))
+	for y := 0; y < mask.Rect.Dy(); y++ {
+		for x := 0; x < y; x++ {
+			mask.Pix[mask.PixOffset(x, y)] = 0xff
+		}
+	}
+
+	downsampled := map[string][]byte{}
+	for name, filter := range map[string]xdraw.Interpolator{"average": nil, "nearest": xdraw.NearestNeighbor, "catmull-rom": xdraw.CatmullRom} {
+		c := NewContext()
+		c.SetSupersampleFilter(filter)
+		small := c.downsample(mask, factor)
+		if b := small.Bounds(); b != image.Rect(0, 0, 16, 16) {
+			t.Fatalf("%s: downsampled to %v, want 16x16", name, b)
+		}
+		downsampled[name] = small.Pix
+	}
+	if bytes.Equal(downsampled["average"], downsampled["nearest"]) || bytes.Equal(downsampled["nearest"], downsampled["catmull-rom"]) || bytes.Equal(downsampled["average"], downsampled["catmull-rom"]) {
+		t.Error("different filters gave the same edge pixels, want each filter to shade the edge its own way")
+	}
+
+	if c := NewContext(); c.sampleFilter != xdraw.CatmullRom {
+		t.Errorf("got default filter %v, want xdraw.CatmullRom", c.sampleFilter)
+	}
+}
+
+func TestWriteLabel(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 200, Height: 60}
+	boxRect := image.Rect(10, 10, 210, 70)
+
+	c := newTestContext(t, 220, 80)
+	c.SetMinFontSize(10)
+	img, fontSize, err := c.WriteLabel("OK", box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fontSize != 40 {
+		t.Errorf("a short word was drawn at size %d, want the max size 40", fontSize)
+	}
+	if ink := inkBounds(img, img.Bounds()); !ink.In(boxRect) {
+		t.Errorf("the label was drawn over %v, want it inside of %v", ink, boxRect)
+	}
+
+	long := strings.Repeat("a label much too long for its chip ", 3)
+	c = newTestContext(t, 220, 80)
+	c.SetMinFontSize(10)
+	img, fontSize, err = c.WriteLabel(long, box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fontSize != 10 {
+		t.Errorf("a long label was drawn at size %d, want the min size 10", fontSize)
+	}
+	ink := inkBounds(img, img.Bounds())
+	if !ink.In(boxRect) {
+		t.Errorf("the long label was drawn over %v, want it cut short inside of %v", ink, boxRect)
+	}
+	if truncated := c.TruncateToWidth(long, box.Width, 10, "\u2026"); !strings.HasSuffix(truncated, "\u2026") || ink.Max.X < boxRect.Max.X-int(c.runesWidth([]rune("\u2026a"), 10)) {
+		t.Errorf("the long label ends at %d, want it cut short with an ellipsis near the end of the box at %d", ink.Max.X, boxRect.Max.X)
+	}
+}
+
+func TestWriteTemplate(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 280, Height: 80}
+	data := map[string]interface{}{"name": "Ada", "seat": 12}
+
+	c := newTestContext(t, 300, 100)
+	img, err := c.WriteTemplate("{{name}} seat {{.seat}}", data, box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mustWriteText(t, newTestContext(t, 300, 100), "Ada seat 12", box)
+	if !reflect.DeepEqual(img, want) {
+		t.Error("the template was drawn differently than its expanded text \"Ada seat 12\"")
+	}
+
+	if _, err := c.WriteTemplate("{{name}} row {{row}}", data, box); err == nil {
+		t.Error("got no error for a placeholder without a value, want one")
+	}
+	if _, err := c.WriteTemplate("{{.row}}", data, box); err == nil {
+		t.Error("got no error for a missing key, want one")
+	}
+	if _, err := c.WriteTemplate("{{name", data, box); err == nil {
+		t.Error("got no error for an unclosed placeholder, want one")
+	}
+}
+
+func TestSetAutoExpand(t *testing.T) {
+	// a box bleeding off the top left corner of the source
+	box := Rectangle{X: -40, Y: -20, Width: 200, Height: 60}
+	c := newTestContext(t, 100, 60)
+	c.SetAutoExpand(true)
+	c.SetExpandColor(Color{0xffff, 0xffff, 0xffff, 0xffff})
+	expanded := mustWriteText(t, c, "Bleeding", box)
+	b := expanded.Bounds()
+	if b.Min.X >= 0 || b.Min.Y >= 0 || !image.Rect(0, 0, 100, 60).In(b) {
+		t.Fatalf("got bounds %v, want the source's (0,0)-(100,60) grown up and to the left", b)
+	}
+
+	// the same annotation drawn well inside of a larger source has every glyph pixel
+	const offset = 100
+	ref := newTestContext(t, 400, 200)
+	whole := mustWriteText(t, ref, "Bleeding", Rectangle{X: box.X + offset, Y: box.Y + offset, Width: box.Width, Height: box.Height})
+	want := inkBounds(whole, whole.Bounds()).Sub(image.Pt(offset, offset))
+	if got := inkBounds(expanded, b); got != want {
+		t.Errorf("the expanded image has ink over %v, want %v", got, want)
+	}
+	if got, want := countInk(expanded, b), countInk(whole, whole.Bounds()); got != want {
+		t.Errorf("the expanded image has %d ink pixels, want all %d", got, want)
+	}
+
+	c = newTestContext(t, 100, 60)
+	if clipped := mustWriteText(t, c, "Bleeding", box); clipped.Bounds() != image.Rect(0, 0, 100, 60) {
+		t.Errorf("got bounds %v without auto expand, want the source's", clipped.Bounds())
+	}
+}
+
+func TestWrapPreview(t *testing.T) {
+	c := newTestContext(t, 300, 200)
+	const fontSize = 12
+	// lines are measured with a space before each word and one after the last, see createTextLines
+	box := Rectangle{X: 0, Y: 0, Width: c.runesWidth([]rune(" one two three "), fontSize) + 1, Height: 200}
+	got := c.WrapPreview("one two three four five\nsix", box, fontSize)
+	if want := "one two three\nfour five\nsix"; got != want {
+		t.Errorf("got preview %q, want %q", got, want)
+	}
+
+	if got := NewContext().WrapPreview("no font", box, fontSize); got != "" {
+		t.Errorf("got preview %q without a font, want \"\"", got)
+	}
+}
+
+// kernedFont returns Go Regular with a kern table added, which kerns b following a by value font units.
+// Go Regular has 2048 units to the em and no kerning of its own
+func kernedFont(t testing.TB, a, b rune, value int16) *truetype.Font {
+	plain := testFont(t)
+	ttf := goregular.TTF
+	numTables := int(binary.BigEndian.Uint16(ttf[4:]))
+	header := 12 + 16*numTables
+
+	// a version 0 kern table with a single horizontal subtable holding one pair
+	kern := make([]byte, 4+14+6)
+	binary.BigEndian.PutUint16(kern[2:], 1)
+	binary.BigEndian.PutUint16(kern[6:], 14+6)
+	binary.BigEndian.PutUint16(kern[8:], 0x0001)
+	binary.BigEndian.PutUint16(kern[10:], 1)
+	binary.BigEndian.PutUint16(kern[12:], 6)
+	binary.BigEndian.PutUint16(kern[18:], uint16(plain.Index(a)))
+	binary.BigEndian.PutUint16(kern[20:], uint16(plain.Index(b)))
+	binary.BigEndian.PutUint16(kern[22:], uint16(value))
+
+	// the table records all move down by the one added for the kern table, and so do the tables
+	out := append([]byte{}, ttf[:header]...)
+	binary.BigEndian.PutUint16(out[4:], uint16(numTables+1))
+	for i := 0; i < numTables; i++ {
+		offset := out[12+16*i+8:]
+		binary.BigEndian.PutUint32(offset, binary.BigEndian.Uint32(offset)+16)
+	}
+	record := make([]byte, 16)
+	copy(record, "kern")
+	binary.BigEndian.PutUint32(record[8:], uint32(len(ttf)+16))
+	binary.BigEndian.PutUint32(record[12:], uint32(len(kern)))
+	out = append(out, record...)
+	out = append(out, ttf[header:]...)
+	out = append(out, kern...)
+
+	font, err := freetype.ParseFont(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return font
+}
+
+func TestSetKerningMode(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 280, Height: 80}
+	render := func(font *truetype.Font, mode KerningMode) (image.Image, int32) {
+		c := newTestContext(t, 300, 100)
+		c.SetFont(font)
+		c.SetKerningMode(mode)
+		return mustWriteText(t, c, "AVAV", box), c.runesWidth([]rune("AV"), 20)
+	}
+	kerned := kernedFont(t, 'A', 'V', -300)
+
+	plainImg, plainWidth := render(testFont(t), KernNative)
+	offImg, offWidth := render(kerned, KernOff)
+	if offWidth != plainWidth || !reflect.DeepEqual(offImg, plainImg) {
+		t.Errorf("with kerning off, the kerned font measured \"AV\" %d wide and was drawn differently than the font without kerning at %d, want the same", offWidth, plainWidth)
+	}
+
+	nativeImg, nativeWidth := render(kerned, KernNative)
+	if nativeWidth >= plainWidth || reflect.DeepEqual(nativeImg, plainImg) {
+		t.Errorf("with native kerning, \"AV\" measured %d wide, want it drawn tighter than %d", nativeWidth, plainWidth)
+	}
+}
+
+func TestCanRender(t *testing.T) {
+	c := newTestContext(t, 1, 1)
+	if !c.CanRender('A') {
+		t.Error("got false for 'A', want the font to have a glyph for it")
+	}
+	// Go Regular has no CJK glyphs
+	if c.CanRender('\u4e2d') {
+		t.Error("got true for U+4E2D, want false for a rune missing from the font")
+	}
+	c.SetRuneMapping(map[rune]rune{'x': '\u4e2d'})
+	if c.CanRender('x') {
+		t.Error("got true for 'x' mapped to a missing rune, want false")
+	}
+	if NewContext().CanRender('A') {
+		t.Error("got true without a font, want false")
+	}
+}
+
+func TestRenderResponsive(t *testing.T) {
+	c := newTestContext(t, 400, 200)
+	src := c.src
+	widths := []int{100, 200, 800}
+	images, err := c.RenderResponsive("Responsive", RectangleRel{X: 0.1, Y: 0.1, Width: 0.8, Height: 0.8}, widths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != len(widths) {
+		t.Fatalf("got %d images, want %d", len(images), len(widths))
+	}
+	for _, width := range widths {
+		img := images[width]
+		if img == nil {
+			t.Fatalf("got no image for width %d", width)
+		}
+		if b := img.Bounds(); b.Dx() != width || b.Dy() != width/2 {
+			t.Errorf("got a %dx%d image for width %d, want %dx%d", b.Dx(), b.Dy(), width, width, width/2)
+		}
+		if countInk(img, img.Bounds()) == 0 {
+			t.Errorf("the image for width %d has no text", width)
+		}
+	}
+	if c.src != src {
+		t.Error("the source of the context was replaced, want it untouched")
+	}
+
+	if _, err := c.RenderResponsive("Responsive", RectangleRel{Width: 1, Height: 1}, []int{0}); err == nil {
+		t.Error("got no error for a width of 0, want one")
+	}
+}
+
+func TestSetRuneMapping(t *testing.T) {
+	const fontSize = 20
+	c := newTestContext(t, 200, 100)
+	wide, narrow := c.runesWidth([]rune("W"), fontSize), c.runesWidth([]rune("i"), fontSize)
+
+	mapping := map[rune]rune{'i': 'W', 'a': '\ue000'}
+	c.SetRuneMapping(mapping)
+	mapping['i'] = 'i'
+	if got := c.runesWidth([]rune("i"), fontSize); got != wide || wide == narrow {
+		t.Errorf("'i' mapped to 'W' measured %d, want the advance of 'W', %d, rather than its own %d", got, wide, narrow)
+	}
+	if got, want := c.runesWidth([]rune("a"), fontSize), c.runesWidth([]rune("\ue000"), fontSize); got != want {
+		t.Errorf("'a' mapped to U+E000 measured %d, want the advance of the glyph drawn for U+E000, %d", got, want)
+	}
+
+	box := Rectangle{X: 10, Y: 10, Width: 180, Height: 80}
+	mapped := mustWriteText(t, c, "iWi", box)
+	want := mustWriteText(t, newTestContext(t, 200, 100), "WWW", box)
+	if !reflect.DeepEqual(mapped, want) {
+		t.Error("\"iWi\" with 'i' mapped to 'W' was drawn differently than \"WWW\"")
+	}
+
+	c.SetRuneMapping(nil)
+	if got := c.runesWidth([]rune("i"), fontSize); got != narrow {
+		t.Errorf("'i' measured %d after clearing the mapping, want %d", got, narrow)
+	}
+}
+
+// writeScratchText draws translucent supersampled text, which draws into a pooled layer and a pooled mask
+func writeScratchText(t testing.TB, c *Context) image.Image {
+	c.SetOpacity(0.8)
+	c.SetSupersample(4)
+	return mustWriteText(t, c, "Pooled buffers", Rectangle{X: 10, Y: 10, Width: 280, Height: 80})
+}
+
+func TestScratchBuffers(t *testing.T) {
+	scratchPools = [len(scratchPools)]sync.Pool{}
+	fresh := writeScratchText(t, newTestContext(t, 300, 100))
+
+	// buffers left in the pools hold whatever was drawn into them last, fill them with garbage to make sure
+	// they're cleared or overwritten before they're used
+	for class := 0; class <= 22; class++ {
+		pix := make([]uint8, 1<<uint(class))
+		for i := range pix {
+			pix[i] = 0xab
+		}
+		scratchPools[class].Put(pix[:0])
+	}
+	pooled := writeScratchText(t, newTestContext(t, 300, 100))
+	if !reflect.DeepEqual(pooled, fresh) {
+		t.Error("drawing with buffers from the pool gave a different image than drawing with new buffers")
+	}
+}
+
+func BenchmarkWriteTextScratch(b *testing.B) {
+	for _, pooled := range []bool{false, true} {
+		name := "fresh"
+		if pooled {
+			name = "pooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			c := newTestContext(b, 1920, 1080)
+			c.SetOpacity(0.8)
+			c.SetSupersample(4)
+			box := Rectangle{X: 100, Y: 100, Width: 800, Height: 200}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !pooled {
+					scratchPools = [len(scratchPools)]sync.Pool{}
+				}
+				if err, _ := c.WriteText("Benchmark", box); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSetTextBackgroundGradient(t *testing.T) {
+	red, blue := Color{0xffff, 0, 0, 0xffff}, Color{0, 0, 0xffff, 0xffff}
+	want := func(col Color) color.RGBA {
+		return color.RGBA{uint8(col.R >> 8), uint8(col.G >> 8), uint8(col.B >> 8), uint8(col.A >> 8)}
+	}
+	box := Rectangle{X: 10, Y: 10, Width: 280, Height: 80}
+	for _, test := range []struct {
+		dir        GradientDirection
+		start, end image.Point
+	}{
+		{GradientVertical, image.Pt(289, 10), image.Pt(289, 89)},
+		{GradientHorizontal, image.Pt(10, 89), image.Pt(289, 89)},
+	} {
+		c := newTestContext(t, 300, 100)
+		c.SetMaxFontSize(10)
+		c.SetTextBackgroundGradient(red, blue, test.dir)
+		img := mustWriteText(t, c, "Card", box).(*image.RGBA)
+		if got := img.RGBAAt(test.start.X, test.start.Y); got != want(red) {
+			t.Errorf("direction %d: the panel starts with %v at %v, want %v", test.dir, got, test.start, want(red))
+		}
+		if got := img.RGBAAt(test.end.X, test.end.Y); got != want(blue) {
+			t.Errorf("direction %d: the panel ends with %v at %v, want %v", test.dir, got, test.end, want(blue))
+		}
+		if got := img.RGBAAt(test.end.X+5, test.end.Y+5); got != (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+			t.Errorf("direction %d: got %v outside of the panel, want the white source", test.dir, got)
+		}
+	}
+}
+
+func TestRenderSVG(t *testing.T) {
+	box := Rectangle{X: 20, Y: 10, Width: 160, Height: 180}
+	text := "Scalable text & <markup> laid out over several lines"
+	c := newTestContext(t, 200, 200)
+	lines, _, err := c.Layout(text, box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := c.RenderSVG(text, box)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var svg struct {
+		Width  int `xml:"width,attr"`
+		Height int `xml:"height,attr"`
+		Text   struct {
+			Family string `xml:"font-family,attr"`
+			Tspans []struct {
+				X    float64 `xml:"x,attr"`
+				Y    float64 `xml:"y,attr"`
+				Text string  `xml:",chardata"`
+			} `xml:"tspan"`
+		} `xml:"text"`
+	}
+	if err := xml.Unmarshal(out, &svg); err != nil {
+		t.Fatalf("got invalid SVG: %v\n%s", err, out)
+	}
+	if svg.Width != 200 || svg.Height != 200 || svg.Text.Family != "Go" {
+		t.Errorf("got a %dx%d document in font %q, want 200x200 in \"Go\"", svg.Width, svg.Height, svg.Text.Family)
+	}
+	if len(lines) < 3 || len(svg.Text.Tspans) != len(lines) {
+		t.Fatalf("got %d tspans for %d wrapped lines, want one per line", len(svg.Text.Tspans), len(lines))
+	}
+	for i, line := range lines {
+		tspan := svg.Text.Tspans[i]
+		if tspan.X != float64(line.XPos) || tspan.Y != float64(line.YPos) {
+			t.Errorf("line %d is at (%v,%v), want (%d,%d)", i, tspan.X, tspan.Y, line.XPos, line.YPos)
+		}
+		if want := strings.Join(line.Words, " "); tspan.Text != want {
+			t.Errorf("line %d is %q, want %q", i, tspan.Text, want)
+		}
+	}
+}
+
+func TestSetWrapHardNewlines(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 200, Height: 180}
+	text := "line one\nlonger line two"
+
+	c := newTestContext(t, 220, 200)
+	wrapped, wrapSize, err := c.Layout(text, box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wrapped) <= 2 {
+		t.Fatalf("got %d lines with wrapping, want the longer line wrapped", len(wrapped))
+	}
+
+	c.SetWrap(false)
+	lines, fontSize, err := c.Layout(text, box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || strings.Join(lines[1].Words, " ") != "longer line two" {
+		t.Fatalf("got %d lines without wrapping, want exactly the two hard lines", len(lines))
+	}
+	if fontSize >= wrapSize {
+		t.Errorf("got size %d without wrapping, want it shrunk below %d", fontSize, wrapSize)
+	}
+	for i, line := range lines {
+		if line.Width() > box.Width {
+			t.Errorf("line %d is %d wide, want it to fit in %d", i, line.Width(), box.Width)
+		}
+	}
+}
+
+func TestSetLineBreakAlgorithm(t *testing.T) {
+	const fontSize = 20
+	box := Rectangle{X: 0, Y: 0, Width: 240, Height: 200}
+	title := "The quick brown fox jumps over the lazy dog"
+	widthVariance := func(algorithm LineBreakAlgorithm) (float64, []string) {
+		c := newTestContext(t, 1, 1)
+		c.SetLineBreakAlgorithm(algorithm)
+		lines := c.WrapText(title, box, fontSize)
+		var sum, squares float64
+		for _, line := range lines {
+			width := float64(c.runesWidth([]rune(line), fontSize))
+			if width > float64(box.Width) {
+				t.Errorf("algorithm %d: %q is %v wide, wider than the box", algorithm, line, width)
+			}
+			sum += width
+			squares += width * width
+		}
+		n := float64(len(lines))
+		return squares/n - (sum/n)*(sum/n), lines
+	}
+
+	greedy, greedyLines := widthVariance(Greedy)
+	balanced, balancedLines := widthVariance(Balanced)
+	if len(greedyLines) != 3 || len(balancedLines) != 3 {
+		t.Fatalf("got %q greedy and %q balanced, want the title on 3 lines both ways", greedyLines, balancedLines)
+	}
+	if balanced >= greedy {
+		t.Errorf("got line width variance %v balanced and %v greedy, want balanced lines closer to the same width: %q and %q", balanced, greedy, balancedLines, greedyLines)
+	}
+	if strings.Join(balancedLines, " ") != title {
+		t.Errorf("balanced lines %q lost or reordered words", balancedLines)
+	}
+}
+
+func TestRectangleHelpers(t *testing.T) {
+	r := Rectangle{X: 10, Y: 20, Width: 100, Height: 50}
+
+	if got := r.Center(); got != image.Pt(60, 45) {
+		t.Errorf("got center %v, want (60,45)", got)
+	}
+	if got := (Rectangle{X: -5, Y: -5, Width: 3, Height: 3}).Center(); got != image.Pt(-4, -4) {
+		t.Errorf("got center %v of an odd sized box, want (-4,-4), rounded toward the top-left", got)
+	}
+
+	insets := []struct {
+		dx, dy int32
+		want   Rectangle
+	}{
+		{5, 10, Rectangle{X: 15, Y: 30, Width: 90, Height: 30}},
+		{-5, -10, Rectangle{X: 5, Y: 10, Width: 110, Height: 70}},
+		{0, 0, r},
+		{60, 10, Rectangle{X: 60, Y: 30, Width: 0, Height: 30}},
+		{10, 30, Rectangle{X: 20, Y: 45, Width: 80, Height: 0}},
+	}
+	for _, test := range insets {
+		if got := r.Inset(test.dx, test.dy); got != test.want {
+			t.Errorf("inset by %d,%d: got %+v, want %+v", test.dx, test.dy, got, test.want)
+		}
+	}
+
+	intersects := []struct {
+		other, want Rectangle
+	}{
+		{Rectangle{X: 50, Y: 0, Width: 100, Height: 40}, Rectangle{X: 50, Y: 20, Width: 60, Height: 20}},
+		{Rectangle{X: 20, Y: 30, Width: 10, Height: 10}, Rectangle{X: 20, Y: 30, Width: 10, Height: 10}},
+		{Rectangle{X: 200, Y: 200, Width: 10, Height: 10}, Rectangle{}},
+		{Rectangle{X: 110, Y: 20, Width: 10, Height: 50}, Rectangle{}},
+	}
+	for _, test := range intersects {
+		if got := r.Intersect(test.other); got != test.want {
+			t.Errorf("%+v intersected with %+v: got %+v, want %+v", r, test.other, got, test.want)
+		}
+		if got := test.other.Intersect(r); got != test.want {
+			t.Errorf("%+v intersected with %+v: got %+v, want %+v", test.other, r, got, test.want)
+		}
+	}
+
+	if got := r.Rect(); got != image.Rect(10, 20, 110, 70) {
+		t.Errorf("got image rectangle %v, want (10,20)-(110,70)", got)
+	}
+	if got := RectangleOf(image.Rect(-10, -20, 30, 40)); got != (Rectangle{X: -10, Y: -20, Width: 40, Height: 60}) {
+		t.Errorf("got %+v from (-10,-20)-(30,40), want a box at -10,-20 of 40x60", got)
+	}
+	if got := RectangleOf(r.Rect()); got != r {
+		t.Errorf("got %+v converting %+v to an image rectangle and back, want it unchanged", got, r)
+	}
+}
+
+func TestSetAspectLock(t *testing.T) {
+	box := Rectangle{X: 0, Y: 0, Width: 900, Height: 200}
+	layout := func(text string, lock bool) ([]*Line, int32) {
+		c := newTestContext(t, 900, 300)
+		c.SetMaxFontSize(200)
+		c.SetAspectLock(lock)
+		lines, fontSize, err := c.Layout(text, box)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lines, fontSize
+	}
+	widest := func(lines []*Line) int32 {
+		width := int32(0)
+		for _, line := range lines {
+			width = larger(width, line.Width())
+		}
+		return width
+	}
+
+	headline := "A fairly long headline that wraps over a few lines in the box"
+	naive, _ := layout(headline, false)
+	locked, _ := layout(headline, true)
+	if len(locked) >= len(naive) || widest(locked) <= widest(naive) {
+		t.Errorf("got %d lines up to %d wide with the aspect lock and %d lines up to %d wide without, want fewer, wider lines in a wide short box",
+			len(locked), widest(locked), len(naive), widest(naive))
+	}
+
+	// hard lines can't get any wider by shrinking, so they're laid out the same and still fit
+	_, naiveSize := layout("Title\nSubtitle", false)
+	locked, lockedSize := layout("Title\nSubtitle", true)
+	if len(locked) != 2 || lockedSize != naiveSize {
+		t.Errorf("got %d lines at size %d with the aspect lock, want the 2 hard lines at size %d", len(locked), lockedSize, naiveSize)
+	}
+	c := newTestContext(t, 900, 300)
+	if bottom := locked[len(locked)-1].YPos + c.descentSpace(lockedSize); bottom > box.Y+box.Height || widest(locked) > box.Width {
+		t.Errorf("the hard lines end at %d and are up to %d wide, want them inside of the box", bottom, widest(locked))
+	}
+}
+
+func TestSetLineRenderedCallback(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 280, Height: 180}
+	text := "first line\n\na last paragraph long enough to be wrapped onto more lines"
+	for _, supersample := range []int{1, 4} {
+		c := newTestContext(t, 300, 200)
+		c.SetSupersample(supersample)
+		lines, _, err := c.Layout(text, box)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var indexes []int
+		c.SetLineRenderedCallback(func(lineIndex int, img image.Image) {
+			indexes = append(indexes, lineIndex)
+			if img == nil {
+				t.Errorf("supersample %d: got no image for line %d", supersample, lineIndex)
+			}
+		})
+		mustWriteText(t, c, text, box)
+		if len(indexes) != len(lines) || len(lines) < 4 {
+			t.Fatalf("supersample %d: the callback was called %d times for %d lines, want once per line", supersample, len(indexes), len(lines))
+		}
+		for i, index := range indexes {
+			if index != i {
+				t.Errorf("supersample %d: got line %d on call %d, want the lines in order", supersample, index, i)
+			}
+		}
+	}
+}
+
+func TestTransparentSource(t *testing.T) {
+	c := NewContext()
+	c.SetFont(testFont(t))
+	c.SetMaxFontSize(40)
+	c.SetFontColor(Color{0xffff, 0, 0, 0xffff})
+	c.SetSrc(image.NewNRGBA(image.Rect(0, 0, 200, 60)))
+	img := mustWriteText(t, c, "Overlay", Rectangle{X: 10, Y: 10, Width: 180, Height: 40})
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := png.Decode(&encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transparent, opaque := 0, 0
+	b := decoded.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := decoded.At(x, y).RGBA()
+			switch {
+			case a == 0:
+				transparent++
+			case g != 0 || bl != 0 || r != a:
+				t.Fatalf("got %v at (%d,%d), want pure red text composited over nothing", decoded.At(x, y), x, y)
+			case a == 0xffff:
+				opaque++
+			}
+		}
+	}
+	if opaque == 0 {
+		t.Error("no text was drawn")
+	}
+	if transparent < b.Dx()*b.Dy()/2 {
+		t.Errorf("got %d transparent pixels, want everything but the text to stay transparent", transparent)
+	}
+}
+
+func TestSetBaselineSnap(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 180, Height: 280}
+	text := "several lines of text spaced by a line height that isn't a whole number of pixels"
+	fractional := func(snap bool) int {
+		c := newTestContext(t, 200, 300)
+		c.SetMaxFontSize(20)
+		c.SetSubPixel(true)
+		c.SetLineHeight(0.37)
+		c.SetBaselineSnap(snap)
+		lines, _, err := c.Layout(text, box)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) < 3 {
+			t.Fatalf("got %d lines, want the text wrapped", len(lines))
+		}
+		count := 0
+		for _, line := range lines {
+			if line.yFrac != 0 {
+				count++
+			}
+		}
+		return count
+	}
+
+	if count := fractional(true); count != 0 {
+		t.Errorf("got %d baselines between pixels with snapping, want every baseline on a whole pixel", count)
+	}
+	if count := fractional(false); count == 0 {
+		t.Error("got every baseline on a whole pixel without snapping, want the exact line height kept")
+	}
+}
+
+func TestSetReservedRegion(t *testing.T) {
+	box := Rectangle{X: 10, Y: 10, Width: 280, Height: 180}
+	text := strings.Repeat("text flowing around the spot where a code will be pasted ", 3)
+	for _, region := range []Rectangle{
+		{X: 200, Y: 10, Width: 90, Height: 90},
+		{X: 10, Y: 60, Width: 90, Height: 60},
+	} {
+		c := newTestContext(t, 300, 200)
+		c.SetMaxFontSize(20)
+		if ink := countInk(mustWriteText(t, c, text, box), region.Rect()); ink == 0 {
+			t.Fatalf("region %+v: the text doesn't reach the region even without reserving it", region)
+		}
+
+		c = newTestContext(t, 300, 200)
+		c.SetMaxFontSize(20)
+		c.SetReservedRegion(region)
+		img := mustWriteText(t, c, text, box)
+		if ink := countInk(img, region.Rect()); ink != 0 {
+			t.Errorf("region %+v: got %d glyph pixels inside of it, want none", region, ink)
+		}
+		if countInk(img, box.Rect()) == 0 {
+			t.Errorf("region %+v: no text was drawn", region)
+		}
+	}
+
+	// a word too wide for the space beside the region is shrunk to fit it when lines have to fit across
+	region := Rectangle{X: 200, Y: 10, Width: 90, Height: 180}
+	c := newTestContext(t, 300, 200)
+	c.SetFitStrategy(FitWidth)
+	c.SetReservedRegion(region)
+	img := mustWriteText(t, c, "Unbreakable", box)
+	if ink := countInk(img, region.Rect()); ink != 0 {
+		t.Errorf("got %d glyph pixels of a long word inside of the region with FitWidth, want none", ink)
+	}
+}
+
+func TestSetBackgroundColorJPEG(t *testing.T) {
+	var transparent bytes.Buffer
+	if err := png.Encode(&transparent, image.NewNRGBA(image.Rect(0, 0, 200, 60))); err != nil {
+		t.Fatal(err)
+	}
+	path := writeFile(t, tempDir(t), "transparent.png", transparent.Bytes())
+	box := Rectangle{X: 10, Y: 10, Width: 180, Height: 40}
+	yellow, white, black := Color{0xffff, 0xffff, 0, 0xffff}, Color{0xffff, 0xffff, 0xffff, 0xffff}, Color{0, 0, 0, 0xffff}
+
+	toJPEG := func(setup func(c *Context)) image.Image {
+		c := NewContext()
+		c.SetFont(testFont(t))
+		c.SetMaxFontSize(40)
+		if err := c.SetSrcPath(path); err != nil {
+			t.Fatal(err)
+		}
+		setup(c)
+		var out bytes.Buffer
+		if err := c.WriteTextTo(&out, "jpeg", "Paper", box); err != nil {
+			t.Fatal(err)
+		}
+		img, err := jpeg.Decode(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+	// JPEG is lossy and shares the color of each 16x16 block between its pixels, so only roughly yellow
+	isPaper := func(col color.Color) bool {
+		r, g, b, _ := col.RGBA()
+		return r >= 0xc000 && g >= 0xc000 && b <= 0x4000
+	}
+	darkPixels := func(img image.Image) int {
+		dark := 0
+		for y := 10; y < 50; y++ {
+			for x := 10; x < 190; x++ {
+				if r, _, _, _ := img.At(x, y).RGBA(); r < 0x8000 {
+					dark++
+				}
+			}
+		}
+		return dark
+	}
+
+	if r, g, b, _ := toJPEG(func(c *Context) {}).At(0, 0).RGBA(); r > 0x1000 || g > 0x1000 || b > 0x1000 {
+		t.Fatalf("got %v in the corner without a background color, want the black JPEG gives transparent pixels", color.RGBA64{uint16(r), uint16(g), uint16(b), 0xffff})
+	}
+	img := toJPEG(func(c *Context) { c.SetBackgroundColor(yellow) })
+	for _, pt := range []image.Point{{0, 0}, {199, 0}, {0, 59}, {199, 59}} {
+		if col := img.At(pt.X, pt.Y); !isPaper(col) {
+			t.Errorf("got %v at %v, want the yellow background color", col, pt)
+		}
+	}
+	if darkPixels(img) == 0 {
+		t.Error("no text was drawn over the background")
+	}
+
+	// the blurred backdrop is blurred from the background, not from the transparent source
+	img = toJPEG(func(c *Context) {
+		c.SetBackgroundColor(yellow)
+		c.SetBackdropBlur(3)
+	})
+	for _, pt := range []image.Point{{185, 14}, {185, 46}} {
+		if col := img.At(pt.X, pt.Y); !isPaper(col) {
+			t.Errorf("got %v at %v with a blurred backdrop, want the yellow background color", col, pt)
+		}
+	}
+
+	// auto contrast measures the white background rather than the transparent source, so the text is dark
+	img = toJPEG(func(c *Context) {
+		c.SetBackgroundColor(white)
+		c.SetFontColorAutoContrast(white, black)
+	})
+	if darkPixels(img) == 0 {
+		t.Error("got no dark text on the white background, want the dark auto contrast color")
+	}
+}
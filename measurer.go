@@ -0,0 +1,58 @@
+/*
+   Copyright (c) 2014 Triple Crown Sports Inc
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+   THE SOFTWARE.
+*/
+
+package Annotate
+
+// Measurer measures and lays out text with the font, DPI and settings a Context had when its Measurer method
+// was called. A Measurer never changes, so it can be shared by goroutines, and the Context can be reconfigured
+// in the meantime without affecting it
+type Measurer struct {
+	c *Context
+}
+
+// Measurer returns a Measurer for the current settings. Settings changed on the Context afterwards are not
+// picked up, call Measurer again for those
+func (c *Context) Measurer() Measurer {
+	snapshot := *c
+	if snapshot.font != nil {
+		// made up front so concurrent measuring never has to set it
+		snapshot.shaper()
+	}
+	return Measurer{c: &snapshot}
+}
+
+// StringWidth returns the advance width of s at fontSize, including kerning and letter spacing
+func (m Measurer) StringWidth(s string, fontSize int32) int32 {
+	if m.c == nil || m.c.font == nil {
+		return 0
+	}
+	return m.c.runesWidth([]rune(s), fontSize)
+}
+
+// MeasureText lays out text inside of boundingBox the same way Context.Layout does, and returns the positioned
+// lines along with the font size they were laid out at
+func (m Measurer) MeasureText(text string, boundingBox Rectangle) ([]*Line, int32, error) {
+	if m.c == nil {
+		return nil, 0, ErrNoFont
+	}
+	return m.c.Layout(text, boundingBox)
+}
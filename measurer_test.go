@@ -0,0 +1,75 @@
+/*
+   Copyright (c) 2014 Triple Crown Sports Inc
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+   THE SOFTWARE.
+*/
+
+package Annotate
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestMeasurerConcurrent(t *testing.T) {
+	c := newTestContext(t, 300, 200)
+	box := Rectangle{X: 10, Y: 10, Width: 280, Height: 180}
+	text := "measured from many goroutines at once while the context changes"
+	m := c.Measurer()
+	wantWidth := m.StringWidth(text, 20)
+	wantLines, wantSize, err := m.MeasureText(text, box)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if width := m.StringWidth(text, 20); width != wantWidth {
+					errs <- fmt.Sprintf("got width %d, want %d", width, wantWidth)
+					return
+				}
+				lines, fontSize, err := m.MeasureText(text, box)
+				if err != nil || fontSize != wantSize || len(lines) != len(wantLines) {
+					errs <- fmt.Sprintf("got %d lines at size %d, error %v, want %d lines at size %d", len(lines), fontSize, err, len(wantLines), wantSize)
+					return
+				}
+			}
+		}()
+	}
+	// reconfiguring the context doesn't affect the measurer
+	for i := 0; i < 50; i++ {
+		c.SetFont(testFont(t))
+		c.SetMaxFontSize(10 + i)
+		c.SetDPI(float64(72 + i))
+		c.SetLetterSpacing(int32(i))
+		c.SetRuneMapping(map[rune]rune{'a': 'W'})
+		mustWriteText(t, c, text, box)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+   Copyright (c) 2014 Triple Crown Sports Inc
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+   THE SOFTWARE.
+*/
+
+package Annotate
+
+// SocialPreset describes the size of an image for a common social media target, and the part of it that is
+// safe for text, i.e. not covered by the app's own buttons and captions
+type SocialPreset struct {
+	Width    int32
+	Height   int32
+	SafeArea Rectangle
+}
+
+var (
+	// InstagramSquare is a 1080x1080 feed post
+	InstagramSquare = SocialPreset{1080, 1080, Rectangle{X: 54, Y: 54, Width: 972, Height: 972}}
+	// InstagramPortrait is a 1080x1350 feed post
+	InstagramPortrait = SocialPreset{1080, 1350, Rectangle{X: 54, Y: 68, Width: 972, Height: 1214}}
+	// InstagramStory is a 1080x1920 story. The top and bottom 250 pixels are covered by the story's controls
+	InstagramStory = SocialPreset{1080, 1920, Rectangle{X: 64, Y: 250, Width: 952, Height: 1420}}
+	// TwitterPost is a 1600x900 in-feed image
+	TwitterPost = SocialPreset{1600, 900, Rectangle{X: 80, Y: 45, Width: 1440, Height: 810}}
+	// FacebookLink is a 1200x630 link preview image
+	FacebookLink = SocialPreset{1200, 630, Rectangle{X: 60, Y: 32, Width: 1080, Height: 566}}
+)
+
+// SafeAreaRel returns the safe area as fractions of the preset's size, which fits sources of any size with the
+// preset's aspect ratio
+func (p SocialPreset) SafeAreaRel() RectangleRel {
+	return RectangleRel{
+		X:      float64(p.SafeArea.X) / float64(p.Width),
+		Y:      float64(p.SafeArea.Y) / float64(p.Height),
+		Width:  float64(p.SafeArea.Width) / float64(p.Width),
+		Height: float64(p.SafeArea.Height) / float64(p.Height),
+	}
+}
+
+// NewContextForPreset returns a Context set up for images of the preset's size, along with the preset's safe
+// area relative to the image, see SafeAreaRel. Call Abs with the bounds of the source to get the bounding box.
+// Text is centered, rendered at 72 DPI so points equal pixels, and sized relative to the image with
+// SetFontSizeRelative, so sources that aren't exactly the preset's size, like a 540x540 InstagramSquare,
+// still work
+func NewContextForPreset(preset SocialPreset) (*Context, RectangleRel) {
+	c := NewContext()
+	c.SetDPI(72)
+	c.SetFontSizeRelative(0.08)
+	c.SetAlignment(CENTERED)
+	return c, preset.SafeAreaRel()
+}
+
+// NewContextForInstagramSquare returns a Context and relative bounding box for InstagramSquare images
+func NewContextForInstagramSquare() (*Context, RectangleRel) {
+	return NewContextForPreset(InstagramSquare)
+}
+
+// NewContextForInstagramPortrait returns a Context and relative bounding box for InstagramPortrait images
+func NewContextForInstagramPortrait() (*Context, RectangleRel) {
+	return NewContextForPreset(InstagramPortrait)
+}
+
+// NewContextForInstagramStory returns a Context and relative bounding box for InstagramStory images
+func NewContextForInstagramStory() (*Context, RectangleRel) {
+	return NewContextForPreset(InstagramStory)
+}
+
+// NewContextForTwitterPost returns a Context and relative bounding box for TwitterPost images
+func NewContextForTwitterPost() (*Context, RectangleRel) {
+	return NewContextForPreset(TwitterPost)
+}
+
+// NewContextForFacebookLink returns a Context and relative bounding box for FacebookLink images
+func NewContextForFacebookLink() (*Context, RectangleRel) {
+	return NewContextForPreset(FacebookLink)
+}
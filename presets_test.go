@@ -0,0 +1,67 @@
+/*
+   Copyright (c) 2014 Triple Crown Sports Inc
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+   THE SOFTWARE.
+*/
+
+package Annotate
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestPresets(t *testing.T) {
+	tests := []struct {
+		name          string
+		newContext    func() (*Context, RectangleRel)
+		preset        SocialPreset
+		width, height int32
+	}{
+		{"instagram square", NewContextForInstagramSquare, InstagramSquare, 1080, 1080},
+		{"instagram portrait", NewContextForInstagramPortrait, InstagramPortrait, 1080, 1350},
+		{"instagram story", NewContextForInstagramStory, InstagramStory, 1080, 1920},
+		{"twitter post", NewContextForTwitterPost, TwitterPost, 1600, 900},
+		{"facebook link", NewContextForFacebookLink, FacebookLink, 1200, 630},
+	}
+	for _, test := range tests {
+		if test.preset.Width != test.width || test.preset.Height != test.height {
+			t.Errorf("%s: got %dx%d, want %dx%d", test.name, test.preset.Width, test.preset.Height, test.width, test.height)
+		}
+		c, rel := test.newContext()
+		full := image.Rect(0, 0, int(test.width), int(test.height))
+		if got := rel.Abs(full); got != test.preset.SafeArea {
+			t.Errorf("%s: got a safe area of %+v, want %+v", test.name, got, test.preset.SafeArea)
+		}
+		if !test.preset.SafeArea.Rect().In(full) {
+			t.Errorf("%s: the safe area %+v isn't inside of the image", test.name, test.preset.SafeArea)
+		}
+
+		// a source at half of the preset's size
+		c.SetFont(testFont(t))
+		c.SetSrc(filledImage(int(test.width/2), int(test.height/2), color.White))
+		safe := rel.Abs(c.src.Bounds())
+		img := mustWriteText(t, c, "Sale ends this weekend, everything must go", safe)
+		ink := inkBounds(img, img.Bounds())
+		if ink.Empty() || !ink.In(safe.Rect().Inset(-2)) {
+			t.Errorf("%s: text was drawn over %v, want it inside of the safe area %v", test.name, ink, safe.Rect())
+		}
+	}
+}
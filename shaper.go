@@ -0,0 +1,94 @@
+/*
+   Copyright (c) 2014 Triple Crown Sports Inc
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+   THE SOFTWARE.
+*/
+
+package Annotate
+
+import (
+	"code.google.com/p/freetype-go/freetype/truetype"
+	"sync"
+)
+
+// Shaper measures text set in a font: the advance of each rune, the kerning between pairs of runes and the
+// width of whole strings. A size is the number of units to the em, the way truetype.Font measures, and widths
+// are in the same units: a size of 12 measures 12 point text in pixels at 72 DPI, and Annotate measures with
+// 26.6 fixed point sizes at the DPI it draws at.
+//
+// Advances are cached per size, so measuring the same text over and over, like the font size search does, only
+// looks each glyph up once. A Shaper is safe for concurrent use, and lookups of cached advances don't lock, so
+// Contexts cloned for AnnotateBatch workers can share one without waiting on each other
+type Shaper struct {
+	font *truetype.Font
+
+	advances sync.Map // advanceKey to int32
+}
+
+// advanceKey identifies a cached glyph advance
+type advanceKey struct {
+	index truetype.Index
+	size  int32
+}
+
+// NewShaper returns a Shaper that measures text set in font
+func NewShaper(font *truetype.Font) *Shaper {
+	return &Shaper{font: font}
+}
+
+// Advance returns how far the pen moves after drawing r at size, not counting kerning
+func (s *Shaper) Advance(r rune, size int32) int32 {
+	return s.advance(s.font.Index(r), size)
+}
+
+// advance returns the advance of the glyph at index at size, from the cache when possible
+func (s *Shaper) advance(index truetype.Index, size int32) int32 {
+	key := advanceKey{index, size}
+	if advance, ok := s.advances.Load(key); ok {
+		return advance.(int32)
+	}
+	advance := s.font.HMetric(size, index).AdvanceWidth
+	s.advances.Store(key, advance)
+	return advance
+}
+
+// Kern returns the kerning adjustment between a and b when b follows a at size. It is usually negative,
+// moving b closer to a, and 0 for most pairs
+func (s *Shaper) Kern(a, b rune, size int32) int32 {
+	return s.font.Kerning(size, s.font.Index(a), s.font.Index(b))
+}
+
+// Measure returns the width of str at size: the advances of its runes plus the kerning between them.
+// Combining marks sit over the rune before them and take up no width
+func (s *Shaper) Measure(str string, size int32) int32 {
+	width := int32(0)
+	prev, hasPrev := truetype.Index(0), false
+	for _, r := range str {
+		if isMark(r) {
+			continue
+		}
+		index := s.font.Index(r)
+		if hasPrev {
+			width += s.font.Kerning(size, prev, index)
+		}
+		width += s.advance(index, size)
+		prev, hasPrev = index, true
+	}
+	return width
+}
@@ -0,0 +1,70 @@
+/*
+   Copyright (c) 2014 Triple Crown Sports Inc
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in
+   all copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+   THE SOFTWARE.
+*/
+
+package Annotate
+
+import (
+	"testing"
+)
+
+func TestShaper(t *testing.T) {
+	s := NewShaper(testFont(t))
+
+	// advance widths from the hmtx table of Go Regular, which has 2048 units to the em. At a size of 2048 the
+	// advances are the font units themselves, and at 768, 12 point at 64 units per point, they scale by 3/8
+	advances := []struct {
+		r           rune
+		units, at12 int32
+	}{
+		{'A', 1366, 512},
+		{'W', 1933, 725},
+		{'a', 1139, 427},
+		{'i', 505, 189},
+		{' ', 569, 213},
+	}
+	for _, test := range advances {
+		if got := s.Advance(test.r, 2048); got != test.units {
+			t.Errorf("got advance %d for %q at size 2048, want %d", got, test.r, test.units)
+		}
+		if got := s.Advance(test.r, 12*64); got != test.at12 {
+			t.Errorf("got advance %d for %q at size 768, want %d", got, test.r, test.at12)
+		}
+	}
+
+	// Go Regular has no kerning table, so no pair is kerned
+	for _, pair := range []string{"AV", "To", "Wa", "ii"} {
+		r := []rune(pair)
+		if kern := s.Kern(r[0], r[1], 2048); kern != 0 {
+			t.Errorf("got kerning %d for %q, want 0", kern, pair)
+		}
+	}
+
+	if got, want := s.Measure("Wai", 2048), int32(1933+1139+505); got != want {
+		t.Errorf("measured %d for \"Wai\", want %d", got, want)
+	}
+	if got, want := s.Measure("a\u0301i", 2048), s.Measure("ai", 2048); got != want {
+		t.Errorf("measured %d with a combining mark, want %d, the mark taking up no width", got, want)
+	}
+	if got := s.Measure("", 2048); got != 0 {
+		t.Errorf("measured %d for the empty string, want 0", got)
+	}
+}